@@ -21,11 +21,18 @@
 package cmd
 
 import (
+	"context"
 	log "github.com/Sirupsen/logrus"
 	"github.com/alexanderGugel/nerva/registry"
 	"github.com/alexanderGugel/nerva/util"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
 // registryCmd represents the registry command
@@ -36,64 +43,266 @@ var registryCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Info(util.Logo)
 
-		storageDir := viper.GetString("backend.storageDir")
-		upstreamURL := viper.GetString("backend.upstreamURL")
-		shaCacheSize := viper.GetInt("cache.shaCacheSize")
-		addr := viper.GetString("listener.addr")
-		frontAddr := viper.GetString("listener.frontAddr")
-		certFile := viper.GetString("listener.certFile")
-		keyFile := viper.GetString("listener.keyFile")
-
+		registryConfig := newRegistryConfig()
 		contextLog := log.WithFields(log.Fields{
-			"storageDir":   storageDir,
-			"upstreamURL":  upstreamURL,
-			"addr":         addr,
-			"frontAddr":    frontAddr,
-			"certFile":     certFile,
-			"keyFile":      keyFile,
-			"shaCacheSize": shaCacheSize,
+			"storageDir":  registryConfig.StorageDir,
+			"upstreamURL": registryConfig.UpstreamURL,
+			"addr":        registryConfig.Addr,
+			"frontAddr":   registryConfig.FrontAddr,
 		})
 
-		registryConfig := &registry.Config{
-			StorageDir:   storageDir,
-			UpstreamURL:  upstreamURL,
-			ShaCacheSize: shaCacheSize,
-			Addr:         addr,
-			CertFile:     certFile,
-			KeyFile:      keyFile,
-			FrontAddr:    frontAddr,
-			Logger:       log.StandardLogger(),
-		}
 		registry, err := registry.New(registryConfig)
 		if err != nil {
 			util.LogFatal(contextLog, err, "failed to create registry")
 		}
 
-		if err := registry.Start(); err != nil {
+		// viper isn't safe for concurrent use, so config file changes and
+		// SIGHUP are both handled by a single goroutine.
+		reloads := make(chan struct{}, 1)
+		go func() {
+			for range reloads {
+				if err := viper.ReadInConfig(); err != nil {
+					util.LogWarn(contextLog, err, "failed to read config file")
+				}
+				reloadRegistry(registry)
+			}
+		}()
+
+		if file := viper.ConfigFileUsed(); file != "" {
+			if err := watchConfigFile(file, reloads); err != nil {
+				util.LogWarn(contextLog, err, "failed to watch config file")
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		go func() {
+			for sig := range signals {
+				contextLog.WithFields(log.Fields{
+					"signal": sig,
+				}).Info("received signal")
+				if sig != syscall.SIGHUP {
+					cancel()
+					return
+				}
+				requestReload(reloads)
+			}
+		}()
+
+		if err := registry.Start(ctx); err != nil {
 			util.LogFatal(contextLog, err, "failed to start registry")
 		}
+		contextLog.Info("stopped registry")
 	},
 }
 
+// newRegistryConfig creates a registry configuration from the current flags,
+// environment variables and config file.
+func newRegistryConfig() *registry.Config {
+	config := &registry.Config{
+		StorageDir:   viper.GetString("backend.storageDir"),
+		UpstreamURL:  viper.GetString("backend.upstreamURL"),
+		NoUpstream:   viper.GetBool("backend.noUpstream"),
+		ShaCacheSize: viper.GetInt("cache.shaCacheSize"),
+		Addr:         viper.GetString("listener.addr"),
+		CertFile:     viper.GetString("listener.certFile"),
+		KeyFile:      viper.GetString("listener.keyFile"),
+		FrontAddr:    viper.GetString("listener.frontAddr"),
+		Logger:       log.StandardLogger(),
+
+		TrustedProxies: viper.GetStringSlice("listener.trustedProxies"),
+
+		ShasumWorkers: viper.GetInt("cache.shasumWorkers"),
+
+		WatchStorage:          viper.GetBool("backend.watchStorage"),
+		StorageRescanInterval: viper.GetDuration("backend.storageRescanInterval"),
+
+		PkgRootCacheSize: viper.GetInt("cache.pkgRootCacheSize"),
+		PkgRootCacheDir:  viper.GetString("cache.pkgRootCacheDir"),
+
+		UpstreamCacheDir: viper.GetString("cache.upstreamCacheDir"),
+		UpstreamCacheTTL: viper.GetDuration("cache.upstreamCacheTTL"),
+
+		UpstreamStaleWhileRevalidate: viper.GetDuration("cache.upstreamStaleWhileRevalidate"),
+		UpstreamNotFoundTTL:          viper.GetDuration("cache.upstreamNotFoundTTL"),
+
+		UpstreamMode:           viper.GetString("backend.upstreamMode"),
+		UpstreamConnectTimeout: viper.GetDuration("backend.upstreamConnectTimeout"),
+		UpstreamReadTimeout:    viper.GetDuration("backend.upstreamReadTimeout"),
+		UpstreamRetries:        viper.GetInt("backend.upstreamRetries"),
+		UpstreamRetryBackoff:   viper.GetDuration("backend.upstreamRetryBackoff"),
+
+		UpstreamHealthInterval:   viper.GetDuration("health.upstreamInterval"),
+		UpstreamFailureThreshold: viper.GetInt("health.upstreamFailureThreshold"),
+		UpstreamBreakerCooldown:  viper.GetDuration("health.upstreamBreakerCooldown"),
+
+		VerifyUpstreamIntegrity:         viper.GetBool("backend.verifyUpstreamIntegrity"),
+		AllowUnverifiedUpstreamTarballs: viper.GetBool("backend.allowUnverifiedUpstreamTarballs"),
+
+		ReservedNames: viper.GetStringSlice("backend.reservedNames"),
+		OverlayNames:  viper.GetStringSlice("backend.overlayNames"),
+		PolicyFile:    viper.GetString("backend.policyFile"),
+		AuditLogFile:  viper.GetString("logging.auditLogFile"),
+
+		ShutdownTimeout:    viper.GetDuration("listener.shutdownTimeout"),
+		ReadyCheckUpstream: viper.GetBool("health.readyCheckUpstream"),
+		ReadyTimeout:       viper.GetDuration("health.readyTimeout"),
+
+		AccessLogSampleRate: viper.GetFloat64("logging.accessLogSampleRate"),
+	}
+	if err := viper.UnmarshalKey("backend.upstreams", &config.Upstreams); err != nil {
+		util.LogWarn(log.WithFields(log.Fields{}), err, "failed to parse upstreams")
+	}
+	return config
+}
+
+// requestReload schedules a reload unless one is already pending.
+func requestReload(reloads chan<- struct{}) {
+	select {
+	case reloads <- struct{}{}:
+	default:
+	}
+}
+
+// watchConfigFile requests a reload whenever the supplied config file changes.
+// The directory is watched instead of the file itself, since editors and
+// Kubernetes ConfigMaps replace the file rather than writing to it.
+func watchConfigFile(file string, reloads chan<- struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+	realFile, _ := filepath.EvalSymlinks(file)
+	go func() {
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				current, _ := filepath.EvalSymlinks(file)
+				written := filepath.Clean(e.Name) == file &&
+					e.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if written || (current != "" && current != realFile) {
+					realFile = current
+					requestReload(reloads)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				util.LogWarn(log.WithFields(log.Fields{
+					"config": file,
+				}), err, "failed to watch config file")
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadRegistry applies the current configuration to the running registry.
+// Changes that require a restart are rejected and logged.
+func reloadRegistry(r *registry.Registry) {
+	contextLog := log.WithFields(log.Fields{
+		"config": viper.ConfigFileUsed(),
+	})
+	if err := r.Reload(newRegistryConfig()); err != nil {
+		util.LogErr(contextLog, err, "failed to reload config")
+		return
+	}
+	// Rejected configs must not change anything, including the logging.
+	initLogFormatter()
+	initLogLevel()
+	contextLog.Info("reloaded config")
+}
+
 func init() {
 	RootCmd.AddCommand(registryCmd)
 
 	registryCmd.Flags().String("addr", ":8200", "address to bind to for listening")
 	registryCmd.Flags().String("frontAddr", "http://127.0.0.1:8200", "full url of front-facing host that nerva will run on")
+	registryCmd.Flags().StringSlice("trustedProxies", nil, "CIDRs of reverse proxies whose X-Forwarded-* headers determine the base URL")
 	registryCmd.Flags().String("certFile", "", "path to TLS certificate file")
 	registryCmd.Flags().String("keyFile", "", "path to TLS key file")
+	registryCmd.Flags().Duration("shutdownTimeout", 30*time.Second, "time to wait for in-flight requests on shutdown")
 
 	registryCmd.Flags().String("storageDir", "./packages", "storage directory to use for Git repositories")
 	registryCmd.Flags().String("upstreamURL", "http://registry.npmjs.com", "upstream Common JS registry")
+	registryCmd.Flags().Bool("watchStorage", true, "watch the storage directory for pushes and new repositories")
+	registryCmd.Flags().Duration("storageRescanInterval", time.Minute, "interval of storage directory rescans (disabled if 0)")
+	registryCmd.Flags().Bool("noUpstream", false, "disable upstream registries and only serve local packages")
+	registryCmd.Flags().String("upstreamMode", "proxy", "upstream mode (proxy or redirect)")
+	registryCmd.Flags().Duration("upstreamConnectTimeout", 5*time.Second, "timeout for connecting to upstream registries")
+	registryCmd.Flags().Duration("upstreamReadTimeout", 30*time.Second, "timeout for reading from upstream registries")
+	registryCmd.Flags().Int("upstreamRetries", 2, "number of retries for failed idempotent upstream requests")
+	registryCmd.Flags().Duration("upstreamRetryBackoff", 200*time.Millisecond, "initial delay between upstream retries")
+	registryCmd.Flags().StringSlice("overlayNames", nil, "package name patterns whose local versions are merged with upstream versions")
+	registryCmd.Flags().Bool("verifyUpstreamIntegrity", true, "verify upstream tarballs against the digests in their package metadata")
+	registryCmd.Flags().Bool("allowUnverifiedUpstreamTarballs", false, "serve upstream tarballs whose digest can't be determined without verification")
+	registryCmd.Flags().String("policyFile", "", "path to policy file for upstream packages")
+	registryCmd.Flags().String("auditLogFile", "", "path to audit log file")
+	registryCmd.Flags().StringSlice("reservedNames", nil, "package name patterns that are never requested from upstream registries")
 	registryCmd.Flags().Int("shaCacheSize", 500, "size of SHA1-cache")
+	registryCmd.Flags().Int("shasumWorkers", 4, "number of goroutines computing tarball shasums in the background (disabled if 0)")
+	registryCmd.Flags().Int("pkgRootCacheSize", 1000, "number of package root documents cached in memory (disabled if 0)")
+	registryCmd.Flags().String("pkgRootCacheDir", "", "directory for caching package root documents on disk (disabled if empty)")
+	registryCmd.Flags().String("upstreamCacheDir", "", "directory for caching upstream packages (disabled if empty)")
+	registryCmd.Flags().Duration("upstreamCacheTTL", 5*time.Minute, "time after which cached upstream package metadata is revalidated")
+	registryCmd.Flags().Duration("upstreamStaleWhileRevalidate", time.Minute, "time after upstreamCacheTTL during which stale package metadata is served while being revalidated")
+	registryCmd.Flags().Duration("upstreamNotFoundTTL", time.Minute, "time for which 404 responses of upstream registries are cached")
+
+	registryCmd.Flags().Bool("readyCheckUpstream", false, "fail readiness probes if the upstream registry is unreachable")
+	registryCmd.Flags().Duration("readyTimeout", 2*time.Second, "timeout for upstream readiness checks")
+	registryCmd.Flags().Duration("upstreamHealthInterval", 10*time.Second, "interval of upstream health checks")
+	registryCmd.Flags().Int("upstreamFailureThreshold", 5, "consecutive upstream failures after which the circuit breaker opens")
+	registryCmd.Flags().Duration("upstreamBreakerCooldown", 30*time.Second, "time after which an open circuit breaker lets a request through")
+
+	registryCmd.Flags().Float64("accessLogSampleRate", 1, "fraction of successful requests to access log")
 
 	viper.BindPFlag("listener.addr", registryCmd.Flags().Lookup("addr"))
 	viper.BindPFlag("listener.frontAddr", registryCmd.Flags().Lookup("frontAddr"))
+	viper.BindPFlag("listener.trustedProxies", registryCmd.Flags().Lookup("trustedProxies"))
 	viper.BindPFlag("listener.certFile", registryCmd.Flags().Lookup("certFile"))
 	viper.BindPFlag("listener.keyFile", registryCmd.Flags().Lookup("keyFile"))
+	viper.BindPFlag("listener.shutdownTimeout", registryCmd.Flags().Lookup("shutdownTimeout"))
 
 	viper.BindPFlag("backend.storageDir", registryCmd.Flags().Lookup("storageDir"))
 	viper.BindPFlag("backend.upstreamURL", registryCmd.Flags().Lookup("upstreamURL"))
+	viper.BindPFlag("backend.watchStorage", registryCmd.Flags().Lookup("watchStorage"))
+	viper.BindPFlag("backend.storageRescanInterval", registryCmd.Flags().Lookup("storageRescanInterval"))
+	viper.BindPFlag("backend.noUpstream", registryCmd.Flags().Lookup("noUpstream"))
+	viper.BindPFlag("backend.upstreamMode", registryCmd.Flags().Lookup("upstreamMode"))
+	viper.BindPFlag("backend.upstreamConnectTimeout", registryCmd.Flags().Lookup("upstreamConnectTimeout"))
+	viper.BindPFlag("backend.upstreamReadTimeout", registryCmd.Flags().Lookup("upstreamReadTimeout"))
+	viper.BindPFlag("backend.upstreamRetries", registryCmd.Flags().Lookup("upstreamRetries"))
+	viper.BindPFlag("backend.upstreamRetryBackoff", registryCmd.Flags().Lookup("upstreamRetryBackoff"))
+	viper.BindPFlag("backend.overlayNames", registryCmd.Flags().Lookup("overlayNames"))
+	viper.BindPFlag("backend.verifyUpstreamIntegrity", registryCmd.Flags().Lookup("verifyUpstreamIntegrity"))
+	viper.BindPFlag("backend.allowUnverifiedUpstreamTarballs", registryCmd.Flags().Lookup("allowUnverifiedUpstreamTarballs"))
+	viper.BindPFlag("backend.policyFile", registryCmd.Flags().Lookup("policyFile"))
+	viper.BindPFlag("logging.auditLogFile", registryCmd.Flags().Lookup("auditLogFile"))
+	viper.BindPFlag("backend.reservedNames", registryCmd.Flags().Lookup("reservedNames"))
 
 	viper.BindPFlag("cache.shaCacheSize", registryCmd.Flags().Lookup("shaCacheSize"))
+	viper.BindPFlag("cache.shasumWorkers", registryCmd.Flags().Lookup("shasumWorkers"))
+	viper.BindPFlag("cache.pkgRootCacheSize", registryCmd.Flags().Lookup("pkgRootCacheSize"))
+	viper.BindPFlag("cache.pkgRootCacheDir", registryCmd.Flags().Lookup("pkgRootCacheDir"))
+	viper.BindPFlag("cache.upstreamCacheDir", registryCmd.Flags().Lookup("upstreamCacheDir"))
+	viper.BindPFlag("cache.upstreamCacheTTL", registryCmd.Flags().Lookup("upstreamCacheTTL"))
+	viper.BindPFlag("cache.upstreamStaleWhileRevalidate", registryCmd.Flags().Lookup("upstreamStaleWhileRevalidate"))
+	viper.BindPFlag("cache.upstreamNotFoundTTL", registryCmd.Flags().Lookup("upstreamNotFoundTTL"))
+
+	viper.BindPFlag("health.readyCheckUpstream", registryCmd.Flags().Lookup("readyCheckUpstream"))
+	viper.BindPFlag("health.readyTimeout", registryCmd.Flags().Lookup("readyTimeout"))
+	viper.BindPFlag("health.upstreamInterval", registryCmd.Flags().Lookup("upstreamHealthInterval"))
+	viper.BindPFlag("health.upstreamFailureThreshold", registryCmd.Flags().Lookup("upstreamFailureThreshold"))
+	viper.BindPFlag("health.upstreamBreakerCooldown", registryCmd.Flags().Lookup("upstreamBreakerCooldown"))
+
+	viper.BindPFlag("logging.accessLogSampleRate", registryCmd.Flags().Lookup("accessLogSampleRate"))
 }
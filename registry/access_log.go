@@ -0,0 +1,101 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexanderGugel/nerva/util"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+type accessKey int
+
+const accessRecordKey accessKey = 0
+
+// accessRecord collects details about a request that are only known to inner
+// handlers, such as whether the request fell back to the upstream registry.
+type accessRecord struct {
+	upstream bool
+}
+
+// getAccessRecord returns the access record attached to the request, if any.
+func getAccessRecord(req *http.Request) *accessRecord {
+	record, _ := req.Context().Value(accessRecordKey).(*accessRecord)
+	return record
+}
+
+// markUpstream flags the request as having been handled by the upstream.
+func markUpstream(req *http.Request) {
+	if record := getAccessRecord(req); record != nil {
+		record.upstream = true
+	}
+}
+
+// wrapAccessLog logs every request that has been handled by the supplied
+// handler. A request id is either propagated from the X-Request-ID header or
+// generated and attached to every log entry made while handling the request.
+// Server errors are always logged, successful requests are sampled according
+// to the configured AccessLogSampleRate.
+func wrapAccessLog(route string, handler http.HandlerFunc,
+	getConfig func() *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		config := getConfig()
+
+		id := req.Header.Get(util.RequestIDHeader)
+		if !util.IsValidRequestID(id) {
+			id = util.NewRequestID()
+			req.Header.Set(util.RequestIDHeader, id)
+		}
+		w.Header().Set(util.RequestIDHeader, id)
+
+		contextLog := config.Logger.WithFields(util.GetRequestFields(req)).
+			WithFields(log.Fields{"requestID": id})
+		record := &accessRecord{}
+		ctx := context.WithValue(req.Context(), accessRecordKey, record)
+		req = util.WithContextLog(req.WithContext(ctx), contextLog)
+
+		sw := &util.StatusWriter{ResponseWriter: w}
+		handler(sw, req)
+
+		code := sw.Code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		if code < http.StatusInternalServerError && rand.Float64() >= config.AccessLogSampleRate {
+			return
+		}
+
+		user, _, _ := req.BasicAuth()
+		contextLog.WithFields(log.Fields{
+			"method":   req.Method,
+			"route":    route,
+			"status":   code,
+			"bytes":    sw.Bytes,
+			"duration": time.Since(start),
+			"user":     user,
+			"upstream": record.upstream,
+		}).Info("handled request")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexanderGugel/nerva/util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func createAccessLogger() (*log.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	logger := log.New()
+	logger.Out = buf
+	logger.Formatter = &log.JSONFormatter{}
+	return logger, buf
+}
+
+func accessLogConfig(logger *log.Logger, sampleRate float64) func() *Config {
+	config := &Config{Logger: logger, AccessLogSampleRate: sampleRate}
+	return func() *Config {
+		return config
+	}
+}
+
+func decodeLogEntries(buf *bytes.Buffer, t *testing.T) []map[string]interface{} {
+	entries := []map[string]interface{}{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		entry := map[string]interface{}{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("dec.Decode failed: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestWrapAccessLogGeneratesRequestID(t *testing.T) {
+	logger, buf := createAccessLogger()
+	handler := wrapAccessLog("/", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}, accessLogConfig(logger, 1))
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+
+	id := w.Header().Get(util.RequestIDHeader)
+	if !util.IsValidRequestID(id) {
+		t.Errorf("w.Header().Get(%v) = %q; want valid request id", util.RequestIDHeader, id)
+	}
+
+	entries := decodeLogEntries(buf, t)
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %v; want %v", len(entries), 1)
+	}
+	if got := entries[0]["requestID"]; got != id {
+		t.Errorf("entries[0][requestID] = %v; want %v", got, id)
+	}
+	if got := entries[0]["status"]; got != float64(http.StatusTeapot) {
+		t.Errorf("entries[0][status] = %v; want %v", got, http.StatusTeapot)
+	}
+}
+
+func TestWrapAccessLogPropagatesRequestID(t *testing.T) {
+	logger, buf := createAccessLogger()
+	id := "some-request-id"
+	handler := wrapAccessLog("/", wrapErrHandle(func(w http.ResponseWriter, req *http.Request) error {
+		return errors.New("failed")
+	}, logger), accessLogConfig(logger, 0))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(util.RequestIDHeader, id)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if got := w.Header().Get(util.RequestIDHeader); got != id {
+		t.Errorf("w.Header().Get(%v) = %q; want %q", util.RequestIDHeader, got, id)
+	}
+
+	entries := decodeLogEntries(buf, t)
+	if len(entries) != 2 {
+		t.Fatalf("len(entries) = %v; want %v", len(entries), 2)
+	}
+	for i, entry := range entries {
+		if got := entry["requestID"]; got != id {
+			t.Errorf("entries[%v][requestID] = %v; want %v", i, got, id)
+		}
+	}
+}
+
+func TestWrapAccessLogSampling(t *testing.T) {
+	logger, buf := createAccessLogger()
+	handler := wrapAccessLog("/", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, accessLogConfig(logger, 0))
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if entries := decodeLogEntries(buf, t); len(entries) != 0 {
+		t.Errorf("len(entries) = %v; want %v", len(entries), 0)
+	}
+}
+
+func TestWrapAccessLogUpstream(t *testing.T) {
+	logger, buf := createAccessLogger()
+	handler := wrapAccessLog("/:name", func(w http.ResponseWriter, req *http.Request) {
+		markUpstream(req)
+	}, accessLogConfig(logger, 1))
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/tape", nil))
+
+	entries := decodeLogEntries(buf, t)
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %v; want %v", len(entries), 1)
+	}
+	if got := entries[0]["upstream"]; got != true {
+		t.Errorf("entries[0][upstream] = %v; want %v", got, true)
+	}
+	if got := entries[0]["route"]; got != "/:name" {
+		t.Errorf("entries[0][route] = %v; want %v", got, "/:name")
+	}
+}
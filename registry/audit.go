@@ -0,0 +1,67 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexanderGugel/nerva/util"
+	"net/http"
+	"os"
+)
+
+// Auditor records security relevant events, such as packages that have been
+// blocked by the policy. Records are either written as JSON to a dedicated
+// file, or to the regular log.
+type Auditor struct {
+	logger *log.Logger
+}
+
+// NewAuditor creates an auditor that appends to the file at path. If path is
+// empty, records are written to logger instead.
+func NewAuditor(path string, logger *log.Logger) (*Auditor, error) {
+	if path == "" {
+		return &Auditor{logger}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	auditLogger := log.New()
+	auditLogger.Out = file
+	auditLogger.Formatter = &log.JSONFormatter{}
+	return &Auditor{auditLogger}, nil
+}
+
+// Record records an event that occurred while handling req.
+func (a *Auditor) Record(req *http.Request, event string, fields log.Fields) {
+	entry := a.logger.WithFields(fields).WithFields(log.Fields{
+		"audit":     true,
+		"event":     event,
+		"requestID": req.Header.Get(util.RequestIDHeader),
+		"remote":    req.RemoteAddr,
+		"method":    req.Method,
+		"url":       req.URL.Path,
+	})
+	if user, _, ok := req.BasicAuth(); ok {
+		entry = entry.WithField("user", user)
+	}
+	entry.Warn(event)
+}
@@ -22,7 +22,57 @@ package registry
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"net"
+	"net/http"
+	"path"
+	"time"
+)
+
+// UpstreamConfig represents the configuration of an upstream registry. Match
+// contains glob patterns (as supported by path.Match) for the names of packages
+// that should be requested from the upstream, e.g. "@partner/*". An upstream
+// without any patterns matches all packages.
+//
+// Mode is either UpstreamModeProxy or UpstreamModeRedirect.
+//
+// An empty Mode as well as zero timeouts and retry settings are inherited from
+// the respective Upstream* fields of Config.
+type UpstreamConfig struct {
+	URL   string
+	Match []string
+	Mode  string
+	Auth  UpstreamAuthConfig
+
+	// ForwardAuth passes the client's Authorization header on to the
+	// upstream. It must only be enabled for upstreams that are trusted with
+	// the credentials of nerva's clients, and can't be combined with Auth.
+	ForwardAuth bool
+
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	Retries        int
+	RetryBackoff   time.Duration
+
+	// NotFoundTTL is how long 404 responses of the upstream are remembered.
+	NotFoundTTL time.Duration
+
+	// HealthInterval is the interval in which the upstream is health checked.
+	// After FailureThreshold consecutive failures, requests to the upstream
+	// fail immediately for BreakerCooldown.
+	HealthInterval   time.Duration
+	FailureThreshold int
+	BreakerCooldown  time.Duration
+}
+
+const (
+	// UpstreamModeProxy fetches packages from the upstream registry and
+	// forwards them to the client.
+	UpstreamModeProxy = "proxy"
+
+	// UpstreamModeRedirect redirects clients to the upstream registry.
+	UpstreamModeRedirect = "redirect"
 )
 
 // Config represents the configuration options of registry.
@@ -35,6 +85,113 @@ type Config struct {
 	KeyFile      string
 	FrontAddr    string
 	Logger       *log.Logger `json:"-"`
+
+	// TrustedProxies contains the CIDRs (or IP addresses) of reverse proxies
+	// whose Forwarded and X-Forwarded-* headers are used to derive the base
+	// URL of package and tarball URLs per request. FrontAddr is used for
+	// all other requests.
+	TrustedProxies []string
+	trustedProxies []*net.IPNet
+
+	// Upstreams is an ordered list of upstream registries. If set, it takes
+	// precedence over UpstreamURL.
+	Upstreams []*UpstreamConfig
+
+	// NoUpstream disables all upstream registries, so that only local
+	// packages are served. Leaving both UpstreamURL and Upstreams empty has
+	// the same effect.
+	NoUpstream bool
+
+	// PkgRootCacheSize is the number of package root documents of local
+	// packages that are cached in memory. The cache is disabled if zero. If
+	// PkgRootCacheDir is set, documents are also cached on disk.
+	PkgRootCacheSize int
+	PkgRootCacheDir  string
+
+	// ShasumWorkers is the number of goroutines computing the shasums of
+	// tarballs in the background. Shasums are computed while handling
+	// requests if zero.
+	ShasumWorkers int
+
+	// WatchStorage enables watching the storage directory for pushes and new
+	// repositories. Repositories are additionally rescanned every
+	// StorageRescanInterval, which is required on file systems without
+	// inotify support. The rescan is disabled if zero.
+	WatchStorage          bool
+	StorageRescanInterval time.Duration
+
+	// UpstreamCacheDir is the directory in which responses of upstream
+	// registries are cached. Caching is disabled if empty. Package root
+	// documents are revalidated after UpstreamCacheTTL.
+	UpstreamCacheDir string
+	UpstreamCacheTTL time.Duration
+
+	// UpstreamStaleWhileRevalidate is how long package root documents are
+	// served from the cache after UpstreamCacheTTL, while they are being
+	// revalidated in the background.
+	UpstreamStaleWhileRevalidate time.Duration
+
+	// UpstreamNotFoundTTL is how long 404 responses of upstream registries
+	// are remembered. 404s aren't cached if zero.
+	UpstreamNotFoundTTL time.Duration
+
+	// UpstreamMode is the default mode of upstream registries.
+	UpstreamMode string
+
+	// UpstreamConnectTimeout and UpstreamReadTimeout limit how long connecting
+	// to and reading from an upstream registry may take. Idempotent requests
+	// are retried up to UpstreamRetries times, starting with a delay of
+	// UpstreamRetryBackoff.
+	UpstreamConnectTimeout time.Duration
+	UpstreamReadTimeout    time.Duration
+	UpstreamRetries        int
+	UpstreamRetryBackoff   time.Duration
+
+	// UpstreamHealthInterval, UpstreamFailureThreshold and
+	// UpstreamBreakerCooldown configure the health checks and circuit breakers
+	// of upstream registries.
+	UpstreamHealthInterval   time.Duration
+	UpstreamFailureThreshold int
+	UpstreamBreakerCooldown  time.Duration
+
+	// VerifyUpstreamIntegrity enables the verification of upstream tarballs
+	// against the digests in their package root documents. Tarballs whose
+	// digest can't be determined are refused, unless
+	// AllowUnverifiedUpstreamTarballs is set.
+	VerifyUpstreamIntegrity         bool
+	AllowUnverifiedUpstreamTarballs bool
+
+	// ReservedNames contains glob patterns for package names that are never
+	// requested from upstream registries, e.g. "@ourcompany/*". This prevents
+	// clients from installing packages published under the same name on a
+	// public registry if the local package is missing.
+	ReservedNames []string
+
+	// OverlayNames contains glob patterns for locally hosted packages whose
+	// versions are merged with those of the upstream registries, e.g. for
+	// forks of public packages. Local versions take precedence.
+	OverlayNames []string
+
+	// PolicyFile is the path to a JSON file containing the policy for
+	// packages of upstream registries. The file is reloaded when it changes.
+	PolicyFile string
+
+	// AuditLogFile is the file security relevant events are appended to. If
+	// empty, they are written to Logger.
+	AuditLogFile string
+
+	// ShutdownTimeout limits how long in-flight requests are drained for when
+	// the registry is being shut down.
+	ShutdownTimeout time.Duration
+
+	// ReadyCheckUpstream marks the upstream registry as a dependency of the
+	// readiness probe.
+	ReadyCheckUpstream bool
+	ReadyTimeout       time.Duration
+
+	// AccessLogSampleRate is the fraction of successful requests that will be
+	// access logged. Server errors are always logged.
+	AccessLogSampleRate float64
 }
 
 // DefaultConfig create a default configuration with sane defaults.
@@ -48,15 +205,109 @@ func DefaultConfig() *Config {
 		KeyFile:      "",
 		FrontAddr:    "http://127.0.0.1:8200",
 		Logger:       log.StandardLogger(),
+
+		PkgRootCacheSize: 1000,
+
+		ShasumWorkers: 4,
+
+		WatchStorage:          true,
+		StorageRescanInterval: time.Minute,
+
+		UpstreamCacheTTL: 5 * time.Minute,
+
+		UpstreamStaleWhileRevalidate: time.Minute,
+		UpstreamNotFoundTTL:          time.Minute,
+
+		UpstreamMode:           UpstreamModeProxy,
+		UpstreamConnectTimeout: 5 * time.Second,
+		UpstreamReadTimeout:    30 * time.Second,
+		UpstreamRetries:        2,
+		UpstreamRetryBackoff:   200 * time.Millisecond,
+
+		VerifyUpstreamIntegrity: true,
+
+		UpstreamHealthInterval:   10 * time.Second,
+		UpstreamFailureThreshold: 5,
+		UpstreamBreakerCooldown:  30 * time.Second,
+
+		ShutdownTimeout: 30 * time.Second,
+		ReadyTimeout:    2 * time.Second,
+
+		AccessLogSampleRate: 1,
 	}
 }
 
+// frontURL returns the base URL of the front-facing host.
+func (c *Config) frontURL() *BaseURL {
+	base, err := NewBaseURL(c.FrontAddr)
+	if err != nil {
+		// Unreachable for validated configs.
+		return &BaseURL{}
+	}
+	return base
+}
+
+// baseURL returns the base URL for the responses to req. It is derived from
+// the request's forwarding headers if it has been sent by a trusted proxy.
+func (c *Config) baseURL(req *http.Request) *BaseURL {
+	front := c.frontURL()
+	if len(c.trustedProxies) == 0 || !isTrustedProxy(req, c.trustedProxies) {
+		return front
+	}
+	return forwardedBaseURL(req, front, c.trustedProxies)
+}
+
 // shouldUseTLS checks if TLS is (partially) configured.
 func (c *Config) shouldUseTLS() bool {
 	return c.CertFile != "" || c.KeyFile != ""
 }
 
-// Validate checks if the supplied config is valid.
+// upstreamConfigs returns the configurations of all upstream registries.
+func (c *Config) upstreamConfigs() []*UpstreamConfig {
+	if c.NoUpstream {
+		return []*UpstreamConfig{}
+	}
+	upstreams := c.Upstreams
+	if len(upstreams) == 0 && c.UpstreamURL != "" {
+		upstreams = []*UpstreamConfig{{URL: c.UpstreamURL}}
+	}
+	configs := []*UpstreamConfig{}
+	for _, upstream := range upstreams {
+		config := *upstream
+		if config.Mode == "" {
+			config.Mode = c.UpstreamMode
+		}
+		if config.ConnectTimeout == 0 {
+			config.ConnectTimeout = c.UpstreamConnectTimeout
+		}
+		if config.ReadTimeout == 0 {
+			config.ReadTimeout = c.UpstreamReadTimeout
+		}
+		if config.Retries == 0 {
+			config.Retries = c.UpstreamRetries
+		}
+		if config.RetryBackoff == 0 {
+			config.RetryBackoff = c.UpstreamRetryBackoff
+		}
+		if config.NotFoundTTL == 0 {
+			config.NotFoundTTL = c.UpstreamNotFoundTTL
+		}
+		if config.HealthInterval == 0 {
+			config.HealthInterval = c.UpstreamHealthInterval
+		}
+		if config.FailureThreshold == 0 {
+			config.FailureThreshold = c.UpstreamFailureThreshold
+		}
+		if config.BreakerCooldown == 0 {
+			config.BreakerCooldown = c.UpstreamBreakerCooldown
+		}
+		configs = append(configs, &config)
+	}
+	return configs
+}
+
+// Validate checks if the supplied config is valid. It also parses
+// TrustedProxies, so that they don't have to be parsed per request.
 func (c *Config) Validate() error {
 	if c.Addr == "" {
 		return errors.New("missing Addr")
@@ -70,8 +321,146 @@ func (c *Config) Validate() error {
 	if c.FrontAddr == "" {
 		return errors.New("missing FrontAddr")
 	}
+	if _, err := NewBaseURL(c.FrontAddr); err != nil {
+		return fmt.Errorf("invalid FrontAddr %q: %v", c.FrontAddr, err)
+	}
+	proxies, err := parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	c.trustedProxies = proxies
 	if c.Logger == nil {
 		return errors.New("missing Logger")
 	}
+	if c.ShasumWorkers < 0 {
+		return errors.New("ShasumWorkers must not be negative")
+	}
+	if c.StorageRescanInterval < 0 {
+		return errors.New("StorageRescanInterval must not be negative")
+	}
+	if c.PkgRootCacheSize < 0 {
+		return errors.New("PkgRootCacheSize must not be negative")
+	}
+	if c.UpstreamRetries < 0 {
+		return errors.New("UpstreamRetries must not be negative")
+	}
+	if c.UpstreamFailureThreshold < 0 {
+		return errors.New("UpstreamFailureThreshold must not be negative")
+	}
+	if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+		return errors.New("AccessLogSampleRate must be between 0 and 1")
+	}
+	for _, pattern := range c.ReservedNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid reserved name %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range c.OverlayNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid overlay name %q: %v", pattern, err)
+		}
+	}
+	if !isValidUpstreamMode(c.UpstreamMode) {
+		return fmt.Errorf("invalid UpstreamMode %q", c.UpstreamMode)
+	}
+	for _, upstream := range c.Upstreams {
+		if upstream.URL == "" {
+			return errors.New("missing upstream URL")
+		}
+		if upstream.Mode != "" && !isValidUpstreamMode(upstream.Mode) {
+			return fmt.Errorf("invalid upstream mode %q", upstream.Mode)
+		}
+		if err := upstream.Auth.Validate(); err != nil {
+			return err
+		}
+		if upstream.ForwardAuth && !upstream.Auth.isEmpty() {
+			return errors.New("upstream can't use both auth and ForwardAuth")
+		}
+		mode := upstream.Mode
+		if mode == "" {
+			mode = c.UpstreamMode
+		}
+		if mode == UpstreamModeRedirect && !upstream.Auth.isEmpty() {
+			return errors.New("upstream auth is not supported in redirect mode")
+		}
+		for _, pattern := range upstream.Match {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid upstream match %q: %v", pattern, err)
+			}
+		}
+	}
+	if c.PolicyFile != "" {
+		// Clients that are redirected bypass the policy.
+		for _, upstream := range c.upstreamConfigs() {
+			if upstream.Mode == UpstreamModeRedirect {
+				return errors.New("PolicyFile is not supported in redirect mode")
+			}
+		}
+	}
+	return nil
+}
+
+// isReserved checks if the package with the given name must not be requested
+// from upstream registries.
+func (c *Config) isReserved(name string) bool {
+	return matchName(c.ReservedNames, name)
+}
+
+// isOverlay checks if the versions of the package with the given name should be
+// merged with those of the upstream registries. Reserved packages are never
+// overlaid.
+func (c *Config) isOverlay(name string) bool {
+	return matchName(c.OverlayNames, name) && !c.isReserved(name)
+}
+
+// matchName checks if the package name matches any of the supplied glob
+// patterns. "*" doesn't match the "/" in scoped package names.
+func matchName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidUpstreamMode checks if the supplied mode is supported. An empty mode
+// defaults to UpstreamModeProxy.
+func isValidUpstreamMode(mode string) bool {
+	switch mode {
+	case "", UpstreamModeProxy, UpstreamModeRedirect:
+		return true
+	}
+	return false
+}
+
+// CheckReload checks if the running registry can switch from this
+// configuration to next without being restarted.
+func (c *Config) CheckReload(next *Config) error {
+	fields := []struct {
+		name          string
+		current, next string
+	}{
+		{"StorageDir", c.StorageDir, next.StorageDir},
+		{"Addr", c.Addr, next.Addr},
+		{"CertFile", c.CertFile, next.CertFile},
+		{"KeyFile", c.KeyFile, next.KeyFile},
+		{"AuditLogFile", c.AuditLogFile, next.AuditLogFile},
+	}
+	for _, field := range fields {
+		if field.current != field.next {
+			return fmt.Errorf("%s can't be changed without restart", field.name)
+		}
+	}
+	if c.Logger != next.Logger {
+		return errors.New("Logger can't be changed without restart")
+	}
+	if c.ShasumWorkers != next.ShasumWorkers {
+		return errors.New("ShasumWorkers can't be changed without restart")
+	}
+	if c.WatchStorage != next.WatchStorage ||
+		c.StorageRescanInterval != next.StorageRescanInterval {
+		return errors.New("storage watcher can't be changed without restart")
+	}
 	return nil
 }
@@ -89,6 +89,146 @@ var configValidateTests = []struct {
 		},
 		isValid: true,
 	},
+	{
+		config: Config{
+			Addr:      ":8200",
+			FrontAddr: "http://127.0.0.1:8200",
+			Logger:    log.StandardLogger(),
+			Upstreams: []*UpstreamConfig{
+				{URL: "http://registry.npmjs.com", Match: []string{"@partner/*"}},
+			},
+		},
+		isValid: true,
+	},
+	{
+		config: Config{
+			Addr:      ":8200",
+			FrontAddr: "http://127.0.0.1:8200",
+			Logger:    log.StandardLogger(),
+			Upstreams: []*UpstreamConfig{
+				{URL: "http://registry.npmjs.com", Match: []string{"[partner"}},
+			},
+		},
+		isValid: false,
+	},
+	{
+		config: Config{
+			Addr:      ":8200",
+			FrontAddr: "http://127.0.0.1:8200",
+			Logger:    log.StandardLogger(),
+			Upstreams: []*UpstreamConfig{{}},
+		},
+		isValid: false,
+	},
+	{
+		config: Config{
+			Addr:      ":8200",
+			FrontAddr: "http://127.0.0.1:8200",
+			Logger:    log.StandardLogger(),
+			Upstreams: []*UpstreamConfig{
+				{URL: "https://npm.partner.com", ForwardAuth: true},
+			},
+		},
+		isValid: true,
+	},
+	{
+		config: Config{
+			Addr:      ":8200",
+			FrontAddr: "http://127.0.0.1:8200",
+			Logger:    log.StandardLogger(),
+			Upstreams: []*UpstreamConfig{{
+				URL:         "https://npm.partner.com",
+				ForwardAuth: true,
+				Auth:        UpstreamAuthConfig{Token: "secret"},
+			}},
+		},
+		isValid: false,
+	},
+	{
+		config: Config{
+			Addr:      ":8200",
+			FrontAddr: "http://127.0.0.1:8200",
+			Logger:    log.StandardLogger(),
+			Upstreams: []*UpstreamConfig{
+				{URL: "http://registry.npmjs.com", Mode: UpstreamModeRedirect},
+			},
+		},
+		isValid: true,
+	},
+	{
+		config: Config{
+			Addr:      ":8200",
+			FrontAddr: "http://127.0.0.1:8200",
+			Logger:    log.StandardLogger(),
+			Upstreams: []*UpstreamConfig{
+				{URL: "http://registry.npmjs.com", Mode: "mirror"},
+			},
+		},
+		isValid: false,
+	},
+	{
+		config: Config{
+			Addr:          ":8200",
+			FrontAddr:     "http://127.0.0.1:8200",
+			Logger:        log.StandardLogger(),
+			ReservedNames: []string{"[ourcompany"},
+		},
+		isValid: false,
+	},
+	{
+		config: Config{
+			Addr:      ":8200",
+			FrontAddr: "https://tools.corp/npm/",
+			Logger:    log.StandardLogger(),
+		},
+		isValid: true,
+	},
+	{
+		config: Config{
+			Addr:      ":8200",
+			FrontAddr: "127.0.0.1:8200",
+			Logger:    log.StandardLogger(),
+		},
+		isValid: false,
+	},
+	{
+		config: Config{
+			Addr:           ":8200",
+			FrontAddr:      "http://127.0.0.1:8200",
+			Logger:         log.StandardLogger(),
+			TrustedProxies: []string{"10.0.0.0/8"},
+		},
+		isValid: true,
+	},
+	{
+		config: Config{
+			Addr:           ":8200",
+			FrontAddr:      "http://127.0.0.1:8200",
+			Logger:         log.StandardLogger(),
+			TrustedProxies: []string{"proxy.corp"},
+		},
+		isValid: false,
+	},
+	{
+		config: Config{
+			Addr:          ":8200",
+			FrontAddr:     "http://127.0.0.1:8200",
+			Logger:        log.StandardLogger(),
+			ShasumWorkers: -1,
+		},
+		isValid: false,
+	},
+	{
+		config: Config{
+			Addr:         ":8200",
+			FrontAddr:    "http://127.0.0.1:8200",
+			Logger:       log.StandardLogger(),
+			UpstreamURL:  "http://registry.npmjs.com",
+			UpstreamMode: UpstreamModeRedirect,
+			PolicyFile:   "policy.json",
+		},
+		isValid: false,
+	},
 }
 
 func TestConfigValidate(t *testing.T) {
@@ -100,3 +240,75 @@ func TestConfigValidate(t *testing.T) {
 		}
 	}
 }
+
+var configCheckReloadTests = []struct {
+	next         Config
+	isReloadable bool
+}{
+	{
+		next: Config{
+			StorageDir:  "./packages",
+			Addr:        ":8200",
+			UpstreamURL: "http://localhost:8080",
+		},
+		isReloadable: true,
+	},
+	{
+		next: Config{
+			StorageDir:   "./packages",
+			Addr:         ":8200",
+			ShaCacheSize: 10,
+		},
+		isReloadable: true,
+	},
+	{
+		next: Config{
+			StorageDir: "./other",
+			Addr:       ":8200",
+		},
+		isReloadable: false,
+	},
+	{
+		next: Config{
+			StorageDir: "./packages",
+			Addr:       ":9000",
+		},
+		isReloadable: false,
+	},
+	{
+		next: Config{
+			StorageDir: "./packages",
+			Addr:       ":8200",
+			CertFile:   "./certFile",
+		},
+		isReloadable: false,
+	},
+}
+
+func TestConfigCheckReload(t *testing.T) {
+	current := &Config{StorageDir: "./packages", Addr: ":8200"}
+	for _, tt := range configCheckReloadTests {
+		err := current.CheckReload(&tt.next)
+		if isReloadable := err == nil; isReloadable != tt.isReloadable {
+			t.Errorf("CheckReload(%v) = %v, want %v", tt.next, isReloadable, tt.isReloadable)
+		}
+	}
+}
+
+func TestConfigUpstreamConfigs(t *testing.T) {
+	tests := []struct {
+		config Config
+		count  int
+	}{
+		{Config{UpstreamURL: "http://registry.npmjs.com"}, 1},
+		{Config{UpstreamURL: ""}, 0},
+		{Config{UpstreamURL: "http://registry.npmjs.com", NoUpstream: true}, 0},
+		{Config{Upstreams: []*UpstreamConfig{{URL: "http://a"}, {URL: "http://b"}}}, 2},
+		{Config{Upstreams: []*UpstreamConfig{{URL: "http://a"}}, NoUpstream: true}, 0},
+	}
+	for _, tt := range tests {
+		if count := len(tt.config.upstreamConfigs()); count != tt.count {
+			t.Errorf("len(%+v.upstreamConfigs()) = %v; want %v", tt.config, count, tt.count)
+		}
+	}
+}
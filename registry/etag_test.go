@@ -0,0 +1,101 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"github.com/libgit2/git2go"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		etag        string
+		matches     bool
+	}{
+		{"", `"abc"`, false},
+		{`"abc"`, "", false},
+		{`"abc"`, `"abc"`, true},
+		{`"abc"`, `"abd"`, false},
+		{`W/"abc"`, `"abc"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`"xyz", "abc"`, `"abc"`, true},
+		{`"xyz","abd"`, `"abc"`, false},
+		{"*", `"abc"`, true},
+	}
+	for _, tt := range tests {
+		if matches := etagMatches(tt.ifNoneMatch, tt.etag); matches != tt.matches {
+			t.Errorf("etagMatches(%q, %q) = %v; want %v", tt.ifNoneMatch, tt.etag, matches, tt.matches)
+		}
+	}
+}
+
+func TestHandlePackageRootNotModified(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	config := *r.config
+	config.NoUpstream = true
+	if err := r.Reload(&config); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+	dir := filepath.Join(config.StorageDir, "tape")
+	if _, err := git.InitRepository(dir, true); err != nil {
+		t.Fatalf("git.InitRepository(%v) failed: %v", dir, err)
+	}
+	endpoint := makePkgRootEndpoint(r)
+
+	w := httptest.NewRecorder()
+	endpoint(w, httptest.NewRequest("GET", "/tape?:name=tape", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET /tape = %v, ETag %q; want %v with ETag", w.Code, etag, http.StatusOK)
+	}
+
+	tests := []struct {
+		ifNoneMatch string
+		frontAddr   string
+		code        int
+	}{
+		{etag, config.FrontAddr, http.StatusNotModified},
+		{`"other"`, config.FrontAddr, http.StatusOK},
+		{etag, "https://tools.corp/npm/", http.StatusOK},
+	}
+	for _, tt := range tests {
+		next := config
+		next.FrontAddr = tt.frontAddr
+		if err := r.Reload(&next); err != nil {
+			t.Fatalf("r.Reload() failed: %v", err)
+		}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/tape?:name=tape", nil)
+		req.Header.Set("If-None-Match", tt.ifNoneMatch)
+		endpoint(w, req)
+		if w.Code != tt.code {
+			t.Errorf("GET /tape with If-None-Match %q and FrontAddr %v = %v; want %v", tt.ifNoneMatch, tt.frontAddr, w.Code, tt.code)
+		}
+		if tt.code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("GET /tape with If-None-Match %q body = %q; want empty", tt.ifNoneMatch, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses a list of CIDRs or single IP addresses.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy checks if the request has been sent by one of the trusted
+// proxies.
+func isTrustedProxy(req *http.Request, proxies []*net.IPNet) bool {
+	return isTrustedAddr(req.RemoteAddr, proxies)
+}
+
+// isTrustedAddr checks if addr, an IP address that might include a port,
+// belongs to one of the trusted proxies.
+func isTrustedAddr(addr string, proxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedBaseURL derives the base URL the client used from the Forwarded or
+// X-Forwarded-Proto/Host/Prefix headers of a request sent by a trusted proxy.
+// Since proxies append to these headers, only the values added by trusted
+// proxies are used. Values that aren't set are taken from front. If the
+// request doesn't contain any of these headers or if they are invalid, front
+// is returned.
+func forwardedBaseURL(req *http.Request, front *BaseURL, proxies []*net.IPNet) *BaseURL {
+	hops := trustedHops(req, proxies)
+	proto, host := parseForwarded(headerValues(req, "Forwarded"), proxies)
+	if proto == "" && host == "" {
+		proto = forwardedValue(req, "X-Forwarded-Proto", hops)
+		host = forwardedValue(req, "X-Forwarded-Host", hops)
+	}
+	prefix := forwardedValue(req, "X-Forwarded-Prefix", hops)
+	if proto == "" && host == "" && prefix == "" {
+		return front
+	}
+	if proto == "" {
+		proto = front.url.Scheme
+	}
+	if host == "" {
+		host = front.url.Host
+	}
+	if prefix == "" {
+		prefix = front.Prefix()
+	} else if prefix[0] != '/' {
+		return front
+	}
+	base, err := NewBaseURL(strings.ToLower(proto) + "://" + host + prefix)
+	if err != nil || base.url.Host != host {
+		return front
+	}
+	return base
+}
+
+// parseForwarded returns the proto and host parameters of the elements of a
+// Forwarded header (RFC 7239). Elements are walked from the right, i.e. from
+// the proxy closest to nerva, as long as they have been forwarded by a trusted
+// proxy. The last element added by a trusted proxy is used, since the ones
+// before it might have been sent by the client.
+func parseForwarded(elements []string, proxies []*net.IPNet) (proto string, host string) {
+	if len(elements) == 0 {
+		return "", ""
+	}
+	i := len(elements) - 1
+	for i > 0 && isTrustedAddr(forwardedParam(elements[i], "for"), proxies) {
+		i--
+	}
+	return forwardedParam(elements[i], "proto"), forwardedParam(elements[i], "host")
+}
+
+// forwardedParam returns the value of the parameter key of a Forwarded
+// element.
+func forwardedParam(element string, key string) string {
+	for _, pair := range strings.Split(element, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], key) {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+// trustedHops returns the number of trusted proxies req has passed through
+// according to its X-Forwarded-For header, including the one that sent it.
+func trustedHops(req *http.Request, proxies []*net.IPNet) int {
+	hops := 1
+	addrs := headerValues(req, "X-Forwarded-For")
+	for i := len(addrs) - 1; i >= 0 && isTrustedAddr(addrs[i], proxies); i-- {
+		hops++
+	}
+	return hops
+}
+
+// forwardedValue returns the value of a comma-separated X-Forwarded-* header
+// that has been added by the trusted proxy closest to the client, given that
+// each of the hops trusted proxies might have appended to it.
+func forwardedValue(req *http.Request, key string, hops int) string {
+	values := headerValues(req, key)
+	if len(values) == 0 {
+		return ""
+	}
+	i := len(values) - hops
+	if i < 0 {
+		i = 0
+	}
+	return values[i]
+}
+
+// headerValues returns the values of a comma-separated header, which might be
+// split across multiple lines.
+func headerValues(req *http.Request, key string) []string {
+	values := []string{}
+	for _, line := range req.Header[http.CanonicalHeaderKey(key)] {
+		for _, value := range strings.Split(line, ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	return values
+}
@@ -0,0 +1,133 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		entries []string
+		ok      bool
+	}{
+		{nil, true},
+		{[]string{"10.0.0.0/8", "127.0.0.1", "::1", "fd00::/8"}, true},
+		{[]string{"10.0.0.0/33"}, false},
+		{[]string{"localhost"}, false},
+	}
+	for _, tt := range tests {
+		_, err := parseTrustedProxies(tt.entries)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("parseTrustedProxies(%v) error = %v; want ok %v", tt.entries, err, tt.ok)
+		}
+	}
+}
+
+func TestConfigBaseURL(t *testing.T) {
+	config := DefaultConfig()
+	config.FrontAddr = "http://127.0.0.1:8200"
+	config.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("config.Validate() failed: %v", err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"10.1.2.3:1234", nil, "http://127.0.0.1:8200"},
+		{"10.1.2.3:1234", map[string]string{
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "npm.vpn.corp",
+		}, "https://npm.vpn.corp"},
+		{"192.0.2.1:1234", map[string]string{
+			"X-Forwarded-For":    "198.51.100.7, 10.0.0.1",
+			"X-Forwarded-Proto":  "https, http",
+			"X-Forwarded-Host":   "tools.corp, proxy.internal",
+			"X-Forwarded-Prefix": "/npm/",
+		}, "https://tools.corp/npm"},
+		{"192.0.2.1:1234", map[string]string{
+			"X-Forwarded-Proto": "https, http",
+			"X-Forwarded-Host":  "tools.corp, proxy.internal",
+		}, "http://proxy.internal"},
+		{"10.1.2.3:1234", map[string]string{
+			"X-Forwarded-For":  "203.0.113.1, 198.51.100.7",
+			"X-Forwarded-Host": "evil.com, npm.corp",
+		}, "http://npm.corp"},
+		{"10.1.2.3:1234", map[string]string{
+			"Forwarded": `for=203.0.113.1;host=evil.com, for=198.51.100.7;host=npm.corp`,
+		}, "http://npm.corp"},
+		{"10.1.2.3:1234", map[string]string{
+			"Forwarded": `for=203.0.113.1;host=evil.com, for=198.51.100.7;host=npm.corp, for="192.0.2.1:4711";host=proxy.internal`,
+		}, "http://npm.corp"},
+		{"10.1.2.3:1234", map[string]string{
+			"Forwarded": `host=tools.corp, for="10.0.0.1:4711";host=npm.corp, for=10.0.0.2;host=proxy.internal`,
+		}, "http://tools.corp"},
+		{"10.1.2.3:1234", map[string]string{
+			"Forwarded":        `for=192.0.2.60;proto=https;host="npm.corp:8443", for=10.0.0.1`,
+			"X-Forwarded-Host": "ignored.corp",
+		}, "https://npm.corp:8443"},
+		{"10.1.2.3:1234", map[string]string{
+			"X-Forwarded-Host": "npm.corp",
+		}, "http://npm.corp"},
+		{"10.1.2.3:1234", map[string]string{
+			"X-Forwarded-Prefix": "/npm",
+		}, "http://127.0.0.1:8200/npm"},
+		{"203.0.113.1:1234", map[string]string{
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "evil.com",
+		}, "http://127.0.0.1:8200"},
+		{"10.1.2.3:1234", map[string]string{
+			"X-Forwarded-Proto": "javascript",
+			"X-Forwarded-Host":  "evil.com",
+		}, "http://127.0.0.1:8200"},
+		{"10.1.2.3:1234", map[string]string{
+			"X-Forwarded-Host": "evil.com/path",
+		}, "http://127.0.0.1:8200"},
+		{"10.1.2.3:1234", map[string]string{
+			"X-Forwarded-Prefix": "npm",
+		}, "http://127.0.0.1:8200"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/tape", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for key, value := range tt.headers {
+			req.Header.Set(key, value)
+		}
+		if got := config.baseURL(req).String(); got != tt.want {
+			t.Errorf("baseURL(%v, %v) = %v; want %v", tt.remoteAddr, tt.headers, got, tt.want)
+		}
+	}
+
+	config.TrustedProxies = nil
+	if err := config.Validate(); err != nil {
+		t.Fatalf("config.Validate() failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/tape", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-Host", "npm.corp")
+	if got, want := config.baseURL(req).String(), "http://127.0.0.1:8200"; got != want {
+		t.Errorf("baseURL() without trusted proxies = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"fmt"
+	"github.com/alexanderGugel/nerva/util"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Health check statuses.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+)
+
+// HealthCheck represents the outcome of an individual health check.
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Health represents the response to a liveness or readiness probe. The overall
+// status is degraded as soon as a single check fails.
+type Health struct {
+	Status string                  `json:"status"`
+	Checks map[string]*HealthCheck `json:"checks"`
+}
+
+// NewHealth creates a new health object without any checks.
+func NewHealth() *Health {
+	return &Health{
+		Status: HealthOK,
+		Checks: map[string]*HealthCheck{},
+	}
+}
+
+// Add records the result of the check with the given name.
+func (h *Health) Add(name string, err error) {
+	check := &HealthCheck{Status: HealthOK}
+	if err != nil {
+		check.Status = HealthDegraded
+		check.Error = err.Error()
+		h.Status = HealthDegraded
+	}
+	h.Checks[name] = check
+}
+
+// Code returns the HTTP status code corresponding to the overall status.
+func (h *Health) Code() int {
+	if h.Status != HealthOK {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// HandleHealthz responds to liveness probes. The registry is considered alive
+// as long as it is able to handle requests.
+func (r *Registry) HandleHealthz(w http.ResponseWriter, req *http.Request) error {
+	return util.RespondJSON(w, http.StatusOK, NewHealth())
+}
+
+// HandleReadyz responds to readiness probes. It checks that the storage
+// directory is readable and that all repositories in it can be opened.
+// Optionally the upstream registry is treated as a dependency.
+func (r *Registry) HandleReadyz(w http.ResponseWriter, req *http.Request) error {
+	health := NewHealth()
+	health.Add("storage", r.checkStorage())
+	health.Add("repos", r.checkRepos())
+	if config := r.getConfig(); config.ReadyCheckUpstream {
+		for _, u := range r.getUpstreams() {
+			health.Add("upstream "+u.URL.String(),
+				u.PingTimeout(config.ReadyTimeout))
+		}
+	}
+	return util.RespondJSON(w, health.Code(), health)
+}
+
+// checkStorage checks if the storage directory is readable.
+func (r *Registry) checkStorage() error {
+	_, err := ioutil.ReadDir(r.storage.Dir)
+	return err
+}
+
+// checkRepos checks if all repositories in the storage directory, including
+// the ones of scoped packages, can be opened.
+func (r *Registry) checkRepos() error {
+	names, err := r.storage.Ls()
+	if err != nil {
+		return err
+	}
+	failed := []string{}
+	for _, name := range names {
+		repo, err := r.storage.GetRepo(name)
+		if err != nil {
+			failed = append(failed, name)
+			continue
+		}
+		repo.Free()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to open repos: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"github.com/alexanderGugel/nerva/storage"
+	"github.com/libgit2/git2go"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createHealthRegistry(dir string, t *testing.T) *Registry {
+	s, err := storage.New(dir)
+	if err != nil {
+		t.Fatalf("storage.New(%v) failed: %v", dir, err)
+	}
+	config := DefaultConfig()
+	config.StorageDir = dir
+	return &Registry{config: config, storage: s}
+}
+
+func TestRegistryHandleHealthz(t *testing.T) {
+	r := &Registry{}
+	w := httptest.NewRecorder()
+
+	if err := r.HandleHealthz(w, nil); err != nil {
+		t.Errorf("r.HandleHealthz failed: %v", err)
+	}
+
+	wantCode := http.StatusOK
+	if gotCode := w.Code; gotCode != wantCode {
+		t.Errorf("w.Code = %v; want %v", gotCode, wantCode)
+	}
+}
+
+func TestRegistryHandleReadyz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := createHealthRegistry(dir, t)
+	w := httptest.NewRecorder()
+
+	if err := r.HandleReadyz(w, nil); err != nil {
+		t.Errorf("r.HandleReadyz failed: %v", err)
+	}
+
+	wantCode := http.StatusOK
+	if gotCode := w.Code; gotCode != wantCode {
+		t.Errorf("w.Code = %v; want %v", gotCode, wantCode)
+	}
+}
+
+func TestRegistryHandleReadyzMissingStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed: %v", err)
+	}
+	r := createHealthRegistry(dir, t)
+	os.RemoveAll(dir)
+
+	w := httptest.NewRecorder()
+	if err := r.HandleReadyz(w, nil); err != nil {
+		t.Errorf("r.HandleReadyz failed: %v", err)
+	}
+
+	wantCode := http.StatusServiceUnavailable
+	if gotCode := w.Code; gotCode != wantCode {
+		t.Errorf("w.Code = %v; want %v", gotCode, wantCode)
+	}
+}
+
+func TestRegistryHandleReadyzBrokenRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "broken"), 0755); err != nil {
+		t.Fatalf("os.Mkdir failed: %v", err)
+	}
+
+	r := createHealthRegistry(dir, t)
+	w := httptest.NewRecorder()
+	if err := r.HandleReadyz(w, nil); err != nil {
+		t.Errorf("r.HandleReadyz failed: %v", err)
+	}
+
+	wantCode := http.StatusServiceUnavailable
+	if gotCode := w.Code; gotCode != wantCode {
+		t.Errorf("w.Code = %v; want %v", gotCode, wantCode)
+	}
+}
+
+func TestRegistryHandleReadyzScopedRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "@scope", "a")
+	if _, err := git.InitRepository(path, true); err != nil {
+		t.Fatalf("git.InitRepository(%v, %t) failed: %v", path, true, err)
+	}
+
+	r := createHealthRegistry(dir, t)
+	w := httptest.NewRecorder()
+	if err := r.HandleReadyz(w, nil); err != nil {
+		t.Errorf("r.HandleReadyz failed: %v", err)
+	}
+
+	wantCode := http.StatusOK
+	if gotCode := w.Code; gotCode != wantCode {
+		t.Errorf("w.Code = %v; want %v", gotCode, wantCode)
+	}
+}
+
+func TestRegistryHandleReadyzUpstreamDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := createHealthRegistry(dir, t)
+	r.config.ReadyCheckUpstream = true
+	r.upstreams = Upstreams{createUpstream("http://localhost:8080", t)}
+
+	w := httptest.NewRecorder()
+	if err := r.HandleReadyz(w, nil); err != nil {
+		t.Errorf("r.HandleReadyz failed: %v", err)
+	}
+
+	wantCode := http.StatusServiceUnavailable
+	if gotCode := w.Code; gotCode != wantCode {
+		t.Errorf("w.Code = %v; want %v", gotCode, wantCode)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// IntegrityError is returned while reading an upstream tarball whose digest
+// doesn't match the digest in the package root document.
+type IntegrityError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity mismatch: expected %v-%v, got %v-%v",
+		e.Algorithm, e.Expected, e.Algorithm, e.Actual)
+}
+
+// asIntegrityError returns the IntegrityError causing err, if any.
+func asIntegrityError(err error) (*IntegrityError, bool) {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	integrityErr, ok := err.(*IntegrityError)
+	return integrityErr, ok
+}
+
+// digest is the expected digest of a tarball.
+type digest struct {
+	algorithm string
+	sum       []byte
+	newHash   func() hash.Hash
+}
+
+// digestAlgorithms are the supported hash algorithms, strongest first.
+var digestAlgorithms = []struct {
+	name    string
+	newHash func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha384", sha512.New384},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+}
+
+// parseIntegrity parses a Subresource Integrity string as used by
+// dist.integrity, e.g. "sha512-...". If it contains multiple digests, the
+// strongest supported one is returned. It returns nil if none is supported.
+func parseIntegrity(integrity string) *digest {
+	sums := map[string][]byte{}
+	for _, field := range strings.Fields(integrity) {
+		parts := strings.SplitN(field, "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		// Options (e.g. "sha512-...?foo") are ignored.
+		value := strings.SplitN(parts[1], "?", 2)[0]
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		sums[parts[0]] = sum
+	}
+	for _, algorithm := range digestAlgorithms {
+		if sum, ok := sums[algorithm.name]; ok {
+			return &digest{algorithm.name, sum, algorithm.newHash}
+		}
+	}
+	return nil
+}
+
+// parseShasum parses a hex encoded SHA1 sum as used by dist.shasum.
+func parseShasum(shasum string) *digest {
+	sum, err := hex.DecodeString(shasum)
+	if err != nil || len(sum) != sha1.Size {
+		return nil
+	}
+	return &digest{"sha1", sum, sha1.New}
+}
+
+// getTarballDigest looks up the expected digest of the tarball with the given
+// file name in a package root document. It returns nil if the document doesn't
+// contain a digest for the tarball.
+func getTarballDigest(doc map[string]interface{}, file string) *digest {
+	versions, _ := doc["versions"].(map[string]interface{})
+	for _, version := range versions {
+		version, _ := version.(map[string]interface{})
+		dist, _ := version["dist"].(map[string]interface{})
+		tarball, _ := dist["tarball"].(string)
+		tarballURL, err := url.Parse(tarball)
+		if err != nil || path.Base(tarballURL.Path) != file {
+			continue
+		}
+		if integrity, ok := dist["integrity"].(string); ok {
+			if d := parseIntegrity(integrity); d != nil {
+				return d
+			}
+		}
+		if shasum, ok := dist["shasum"].(string); ok {
+			return parseShasum(shasum)
+		}
+	}
+	return nil
+}
+
+type digestKey struct{}
+
+// withDigest returns a copy of ctx carrying the expected digest of the
+// requested tarball.
+func withDigest(ctx context.Context, d *digest) context.Context {
+	return context.WithValue(ctx, digestKey{}, d)
+}
+
+// getDigest returns the expected digest stored in ctx, or nil.
+func getDigest(ctx context.Context) *digest {
+	d, _ := ctx.Value(digestKey{}).(*digest)
+	return d
+}
+
+// verifyingBody checks the digest of a body while it is being read. Instead
+// of io.EOF, an IntegrityError is returned if the digest doesn't match.
+// onMismatch is called once in that case, if set.
+type verifyingBody struct {
+	io.ReadCloser
+	digest     *digest
+	hash       hash.Hash
+	onMismatch func()
+	err        error
+}
+
+// newVerifyingBody wraps body, so that it is verified against d.
+func newVerifyingBody(body io.ReadCloser, d *digest, onMismatch func()) *verifyingBody {
+	return &verifyingBody{
+		ReadCloser: body,
+		digest:     d,
+		hash:       d.newHash(),
+		onMismatch: onMismatch,
+	}
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+	if sum := b.hash.Sum(nil); !bytes.Equal(sum, b.digest.sum) {
+		b.err = &IntegrityError{
+			Algorithm: b.digest.algorithm,
+			Expected:  base64.StdEncoding.EncodeToString(b.digest.sum),
+			Actual:    base64.StdEncoding.EncodeToString(sum),
+		}
+		if b.onMismatch != nil {
+			b.onMismatch()
+		}
+		return n, b.err
+	}
+	return n, io.EOF
+}
+
+// verifyingTransport verifies successful responses to requests carrying an
+// expected digest.
+type verifyingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip wraps the response body if its digest is known.
+func (t *verifyingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+	if d := getDigest(req.Context()); d != nil {
+		res.Body = newVerifyingBody(res.Body, d, nil)
+	}
+	return res, nil
+}
@@ -0,0 +1,232 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sha512Integrity(body string) string {
+	sum := sha512.Sum512([]byte(body))
+	return "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func sha1Shasum(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseIntegrity(t *testing.T) {
+	sha1Sum := sha1.Sum([]byte("tape"))
+	sha1Integrity := "sha1-" + base64.StdEncoding.EncodeToString(sha1Sum[:])
+
+	tests := []struct {
+		integrity string
+		algorithm string
+	}{
+		{sha512Integrity("tape"), "sha512"},
+		{sha1Integrity, "sha1"},
+		{sha1Integrity + " " + sha512Integrity("tape"), "sha512"},
+		{"md5-dGFwZQ==", ""},
+		{"sha512-not base64!", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		algorithm := ""
+		if d := parseIntegrity(tt.integrity); d != nil {
+			algorithm = d.algorithm
+		}
+		if algorithm != tt.algorithm {
+			t.Errorf("parseIntegrity(%q).algorithm = %q; want %q", tt.integrity, algorithm, tt.algorithm)
+		}
+	}
+}
+
+func TestGetTarballDigest(t *testing.T) {
+	doc := map[string]interface{}{
+		"versions": map[string]interface{}{
+			"1.0.0": map[string]interface{}{
+				"dist": map[string]interface{}{
+					"tarball":   "https://registry.npmjs.org/tape/-/tape-1.0.0.tgz",
+					"shasum":    sha1Shasum("tape-1.0.0"),
+					"integrity": sha512Integrity("tape-1.0.0"),
+				},
+			},
+			"2.0.0": map[string]interface{}{
+				"dist": map[string]interface{}{
+					"tarball": "https://registry.npmjs.org/tape/-/tape-2.0.0.tgz",
+					"shasum":  sha1Shasum("tape-2.0.0"),
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		file      string
+		algorithm string
+	}{
+		{"tape-1.0.0.tgz", "sha512"},
+		{"tape-2.0.0.tgz", "sha1"},
+		{"tape-3.0.0.tgz", ""},
+	}
+	for _, tt := range tests {
+		algorithm := ""
+		if d := getTarballDigest(doc, tt.file); d != nil {
+			algorithm = d.algorithm
+		}
+		if algorithm != tt.algorithm {
+			t.Errorf("getTarballDigest(%q).algorithm = %q; want %q", tt.file, algorithm, tt.algorithm)
+		}
+	}
+}
+
+func TestVerifyingBody(t *testing.T) {
+	d := parseIntegrity(sha512Integrity("tarball"))
+	tests := []struct {
+		body     string
+		mismatch bool
+	}{
+		{"tarball", false},
+		{"tampered", true},
+	}
+	for _, tt := range tests {
+		mismatch := false
+		body := newVerifyingBody(ioutil.NopCloser(strings.NewReader(tt.body)), d, func() {
+			mismatch = true
+		})
+		_, err := ioutil.ReadAll(body)
+		if _, ok := asIntegrityError(err); ok != tt.mismatch {
+			t.Errorf("ioutil.ReadAll(%q) = %v; want mismatch = %t", tt.body, err, tt.mismatch)
+		}
+		if mismatch != tt.mismatch {
+			t.Errorf("%q: onMismatch called = %t; want %t", tt.body, mismatch, tt.mismatch)
+		}
+	}
+}
+
+// bufferingTransport reads response bodies completely before returning them.
+type bufferingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *bufferingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+func TestRegistryHandleUpstreamIntegrityMismatch(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/tape" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"versions": {"1.0.0": {"dist": {
+				"tarball": "` + server.URL + `/tape/-/tape-1.0.0.tgz",
+				"integrity": "` + sha512Integrity("tarball") + `"}}}}`))
+			return
+		}
+		w.Write([]byte("tampered"))
+	}))
+	defer server.Close()
+
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	url := "/tape/-/tape-1.0.0.tgz?:name=tape&:file=tape-1.0.0.tgz"
+
+	// Buffered tarballs are verified before the response is written.
+	upstream := createUpstream(server.URL, t)
+	upstream.Client.Transport = &bufferingTransport{upstream.Client.Transport}
+	r.upstreams = Upstreams{upstream}
+	w := httptest.NewRecorder()
+	if err := r.HandleUpstream(w, httptest.NewRequest("GET", url, nil)); err != nil {
+		t.Errorf("r.HandleUpstream(%v) failed: %v", url, err)
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("r.HandleUpstream(%v) code = %v; want %v", url, w.Code, http.StatusBadGateway)
+	}
+
+	// Streamed tarballs are only verified once they have been sent.
+	r.upstreams = Upstreams{createUpstream(server.URL, t)}
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("recover() = %v; want %v", err, http.ErrAbortHandler)
+		}
+	}()
+	r.HandleUpstream(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	t.Errorf("r.HandleUpstream(%v) didn't abort the streamed response", url)
+}
+
+func TestRegistryHandleUpstreamUnknownDigest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/tape":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"versions": {}}`))
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte("tarball"))
+		}
+	}))
+	defer server.Close()
+
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	r.upstreams = Upstreams{createUpstream(server.URL, t)}
+
+	tests := []struct {
+		url   string
+		allow bool
+		code  int
+	}{
+		{"/tape/-/tape-1.0.0.tgz?:name=tape&:file=tape-1.0.0.tgz", false, http.StatusBadGateway},
+		{"/broken/-/broken-1.0.0.tgz?:name=broken&:file=broken-1.0.0.tgz", false, http.StatusBadGateway},
+		{"/tape/-/tape-1.0.0.tgz?:name=tape&:file=tape-1.0.0.tgz", true, http.StatusOK},
+		{"/broken/-/broken-1.0.0.tgz?:name=broken&:file=broken-1.0.0.tgz", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		r.config.AllowUnverifiedUpstreamTarballs = tt.allow
+		w := httptest.NewRecorder()
+		if err := r.HandleUpstream(w, httptest.NewRequest("GET", tt.url, nil)); err != nil {
+			t.Errorf("r.HandleUpstream(%v) failed: %v", tt.url, err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("allow = %v: r.HandleUpstream(%v) code = %v; want %v", tt.allow, tt.url, w.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexanderGugel/nerva/util"
+	"net/http"
+)
+
+const (
+	// PkgSourceField marks the origin of each version in overlaid package root
+	// documents.
+	PkgSourceField = "_source"
+
+	// PkgSourceLocal marks versions that are served from the local repository.
+	PkgSourceLocal = "local"
+
+	// PkgSourceUpstream marks versions that are served from an upstream
+	// registry.
+	PkgSourceUpstream = "upstream"
+)
+
+// writeOverlayPkgRoot merges the local package root with the package root
+// document of the upstream registries. Local versions replace upstream
+// versions of the same name. Upstream dist-tags are kept, while the latest
+// local version is tagged as "local". If the upstream registries don't have
+// the package or can't be reached, only local versions are served.
+func (r *Registry) writeOverlayPkgRoot(w http.ResponseWriter,
+	req *http.Request, root *PackageRoot) error {
+	config := r.getConfig()
+	contextLog := util.ContextLog(req, config.Logger).WithFields(log.Fields{
+		"name": root.Name,
+	})
+
+	upstreams := r.getUpstreams()
+	if len(upstreams) == 0 {
+		doc := map[string]interface{}{}
+		mergePkgRoots(doc, root)
+		return util.RespondJSON(w, http.StatusOK, doc)
+	}
+
+	markUpstream(req)
+	doc, err := upstreams.FetchPkgRoot(req, root.Name)
+	if err != nil {
+		util.LogWarn(contextLog, err, "failed to fetch upstream package root")
+		doc = map[string]interface{}{}
+	} else {
+		if policy := r.getPolicy(); policy != nil {
+			r.filterPkgRoot(policy)(req, root.Name, doc)
+		}
+		rewriteTarballURLs(doc, root.Name, config.baseURL(req))
+	}
+	mergePkgRoots(doc, root)
+	return util.RespondJSON(w, http.StatusOK, doc)
+}
+
+// mergePkgRoots merges the local package root into the upstream package root
+// document and marks the source of each version.
+func mergePkgRoots(doc map[string]interface{}, root *PackageRoot) {
+	doc["name"] = root.Name
+
+	versions, ok := doc["versions"].(map[string]interface{})
+	if !ok {
+		versions = map[string]interface{}{}
+		doc["versions"] = versions
+	}
+	for _, version := range versions {
+		if version, ok := version.(map[string]interface{}); ok {
+			version[PkgSourceField] = PkgSourceUpstream
+		}
+	}
+	for version, pkgVersion := range *root.Versions {
+		(*pkgVersion)[PkgSourceField] = PkgSourceLocal
+		versions[version] = pkgVersion
+	}
+
+	distTags, ok := doc["dist-tags"].(map[string]interface{})
+	if !ok {
+		distTags = map[string]interface{}{}
+		doc["dist-tags"] = distTags
+	}
+	if latest, ok := (*root.DistTags)["latest"]; ok {
+		distTags[PkgSourceLocal] = latest
+		if _, ok := distTags["latest"]; !ok {
+			distTags["latest"] = latest
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"testing"
+)
+
+func TestMergePkgRoots(t *testing.T) {
+	doc := map[string]interface{}{
+		"name":      "tape",
+		"dist-tags": map[string]interface{}{"latest": "1.2.4"},
+		"versions": map[string]interface{}{
+			"1.2.3": map[string]interface{}{"version": "1.2.3"},
+			"1.2.4": map[string]interface{}{"version": "1.2.4"},
+		},
+	}
+	root := &PackageRoot{
+		Name:     "tape",
+		DistTags: &PackageDistTags{"latest": "1.2.4-ourfix"},
+		Versions: &PkgRootVersions{
+			"1.2.4":        &PkgVersion{"version": "1.2.4", "fork": true},
+			"1.2.4-ourfix": &PkgVersion{"version": "1.2.4-ourfix"},
+		},
+	}
+	mergePkgRoots(doc, root)
+
+	versions := doc["versions"].(map[string]interface{})
+	tests := []struct {
+		version string
+		source  string
+	}{
+		{"1.2.3", PkgSourceUpstream},
+		{"1.2.4", PkgSourceLocal},
+		{"1.2.4-ourfix", PkgSourceLocal},
+	}
+	for _, tt := range tests {
+		var source interface{}
+		switch version := versions[tt.version].(type) {
+		case map[string]interface{}:
+			source = version[PkgSourceField]
+		case *PkgVersion:
+			source = (*version)[PkgSourceField]
+		}
+		if source != tt.source {
+			t.Errorf("versions[%q][%q] = %v; want %v", tt.version, PkgSourceField, source, tt.source)
+		}
+	}
+	if fork := (*versions["1.2.4"].(*PkgVersion))["fork"]; fork != true {
+		t.Errorf("local version 1.2.4 should replace upstream version")
+	}
+
+	distTags := doc["dist-tags"].(map[string]interface{})
+	if latest := distTags["latest"]; latest != "1.2.4" {
+		t.Errorf("dist-tags.latest = %v; want %v", latest, "1.2.4")
+	}
+	if local := distTags[PkgSourceLocal]; local != "1.2.4-ourfix" {
+		t.Errorf("dist-tags.local = %v; want %v", local, "1.2.4-ourfix")
+	}
+}
+
+func TestMergePkgRootsWithoutUpstream(t *testing.T) {
+	doc := map[string]interface{}{}
+	root := &PackageRoot{
+		Name:     "tape",
+		DistTags: &PackageDistTags{"latest": "1.0.0"},
+		Versions: &PkgRootVersions{"1.0.0": &PkgVersion{"version": "1.0.0"}},
+	}
+	mergePkgRoots(doc, root)
+
+	if name := doc["name"]; name != "tape" {
+		t.Errorf("doc.name = %v; want %v", name, "tape")
+	}
+	distTags := doc["dist-tags"].(map[string]interface{})
+	if latest := distTags["latest"]; latest != "1.0.0" {
+		t.Errorf("dist-tags.latest = %v; want %v", latest, "1.0.0")
+	}
+	if versions := doc["versions"].(map[string]interface{}); len(versions) != 1 {
+		t.Errorf("len(versions) = %v; want %v", len(versions), 1)
+	}
+}
+
+func TestConfigIsOverlay(t *testing.T) {
+	config := &Config{
+		OverlayNames:  []string{"tape", "@ourcompany/*"},
+		ReservedNames: []string{"@ourcompany/*"},
+	}
+	tests := []struct {
+		name      string
+		isOverlay bool
+	}{
+		{"tape", true},
+		{"ied", false},
+		{"@ourcompany/tape", false},
+	}
+	for _, tt := range tests {
+		if isOverlay := config.isOverlay(tt.name); isOverlay != tt.isOverlay {
+			t.Errorf("config.isOverlay(%q) = %t; want %t", tt.name, isOverlay, tt.isOverlay)
+		}
+	}
+}
@@ -25,15 +25,24 @@ import (
 	"github.com/alexanderGugel/nerva/util"
 	"github.com/libgit2/git2go"
 	"net/http"
+	"strconv"
 )
 
-// HandlePkgDownload handles package downloads.
+// tarballCacheControl allows clients and CDNs to cache local tarballs
+// indefinitely.
+const tarballCacheControl = "public, max-age=31536000, immutable"
+
+// HandlePkgDownload handles package downloads. Downloads of overlaid packages
+// that don't refer to a git object are forwarded to the upstream registries.
 func (r *Registry) HandlePkgDownload(repo *git.Repository,
 	w http.ResponseWriter, req *http.Request) error {
 	version := req.URL.Query().Get(":version")
 
 	id, err := git.NewOid(version)
 	if err != nil || id == nil {
+		if r.getConfig().isOverlay(getPkgName(req)) {
+			return r.HandleUpstream(w, req)
+		}
 		code := http.StatusBadRequest
 		res := &util.ErrorResponse{
 			http.StatusText(code),
@@ -43,17 +52,19 @@ func (r *Registry) HandlePkgDownload(repo *git.Repository,
 	}
 
 	d, err := storage.NewDownload(repo, id)
-	if err != nil || d == nil {
-		if gitErr, ok := err.(*git.GitError); !ok ||
-			gitErr.Class != git.ErrClassOdb {
-			return err
-		}
-		code := http.StatusNotFound
-		res := &util.ErrorResponse{
-			http.StatusText(code),
-			"package not found",
-		}
-		return util.RespondJSON(w, code, res)
+	if err != nil {
+		return err
+	}
+	// Tarballs are identified by their git object id and therefore never
+	// change.
+	w.Header().Set("Cache-Control", tarballCacheControl)
+	if checkNotModified(w, req, `"`+id.String()+`"`) {
+		return nil
+	}
+	// The tarball is streamed, so its size is only known if it has been
+	// recorded while computing its shasum.
+	if size, ok := r.getShaCache().Size(*id); ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 	}
 	return d.Start(w)
 }
@@ -23,12 +23,15 @@ package registry
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	log "github.com/Sirupsen/logrus"
 	"github.com/alexanderGugel/nerva/storage"
 	"github.com/alexanderGugel/nerva/util"
 	"github.com/libgit2/git2go"
+	"io"
 	"net/http"
 	"regexp"
+	"strconv"
 )
 
 // PackageRoot represents a CommonJS package root document containing all
@@ -49,6 +52,11 @@ type PackageRoot struct {
 	Name     string           `json:"name"`
 	DistTags *PackageDistTags `json:"dist-tags"`
 	Versions *PkgRootVersions `json:"versions"`
+
+	// incomplete is set if versions have been skipped because of errors, e.g.
+	// because their shasums couldn't be computed. Such documents must neither
+	// be cached nor identified by the ETag of the repository's tags.
+	incomplete bool
 }
 
 // PkgRootVersions represents the versions map in a package root document
@@ -67,13 +75,24 @@ type PackageDist struct {
 
 var versionTagRef = regexp.MustCompile("^refs\\/tags\\/v(.*)$")
 
-// NewPackageRoot creates a new CommonJS package root document.
-func NewPackageRoot(name string, url string, repo *git.Repository,
-	shaCache *storage.ShaCache) (*PackageRoot, error) {
+// NewPackageRoot creates a new CommonJS package root document. Shasums that
+// aren't cached are computed by the supplied pool, or serially if pool is nil.
+func NewPackageRoot(name string, base *BaseURL, repo *git.Repository,
+	shaCache *storage.ShaCache, pool *ShasumPool,
+	contextLog *log.Entry) (*PackageRoot, error) {
 	versions := PkgRootVersions{}
-	contextLog := log.WithFields(log.Fields{"name": name})
-
-	latest := ""
+	contextLog = contextLog.WithFields(log.Fields{"name": name})
+
+	// pending are the versions whose shasums are being computed by the pool.
+	type pendingVersion struct {
+		version    string
+		pkgVersion *PkgVersion
+		job        *ShasumJob
+		contextLog *log.Entry
+	}
+	pending := []pendingVersion{}
+	order := []string{}
+	incomplete := false
 
 	if err := repo.Tags.Foreach(func(tagRef string, id *git.Oid) error {
 		contextLog := contextLog.WithFields(log.Fields{"tagRef": tagRef})
@@ -87,6 +106,7 @@ func NewPackageRoot(name string, url string, repo *git.Repository,
 		contextLog = contextLog.WithFields(log.Fields{"PkgVersion": PkgVersion})
 		if err != nil || PkgVersion == nil {
 			util.LogErr(contextLog, err, "failed to generate package version")
+			incomplete = true
 			return nil
 		}
 		if version, ok := (*PkgVersion)["version"].(string); ok {
@@ -94,53 +114,137 @@ func NewPackageRoot(name string, url string, repo *git.Repository,
 			if versions[version] != nil {
 				contextLog.Warn("duplicate version")
 			}
-			tarball := url + "/" + name + "/-/" + id.String() + ".tgz"
+			tarball := base.Tarball(name, id.String()+".tgz")
+			dist := &PackageDist{Tarball: tarball}
 
 			shasum, ok := shaCache.Get(*id)
-			if !ok {
-				hasher := sha1.New()
-				d, err := storage.NewDownload(repo, id)
-				if err != nil || d == nil {
-					util.LogErr(contextLog, err, "failed to create download")
+			if !ok && pool != nil {
+				job := pool.Get(name, *id)
+				pending = append(pending, pendingVersion{
+					version, PkgVersion, job, contextLog,
+				})
+			} else if !ok {
+				var size int64
+				if shasum, size, err = computeShasum(repo, id); err != nil {
+					util.LogErr(contextLog, err, "failed to compute shasum")
+					incomplete = true
 					return nil
 				}
-				if err := d.Start(hasher); err != nil {
-					util.LogErr(contextLog, err, "failed to start download")
-					return nil
-				}
-				shasum = hex.EncodeToString(hasher.Sum(nil))
+				shaCache.Add(*id, shasum, size)
 			}
 
-			shaCache.Add(*id, shasum)
-			(*PkgVersion)["dist"] = &PackageDist{tarball, shasum}
+			dist.Shasum = shasum
+			(*PkgVersion)["dist"] = dist
 			versions[version] = PkgVersion
-			latest = version
+			order = append(order, version)
 		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 
+	// Only wait for the versions that weren't cached.
+	for _, p := range pending {
+		shasum, err := p.job.Wait()
+		if err != nil {
+			util.LogErr(p.contextLog, err, "failed to compute shasum")
+			if versions[p.version] == p.pkgVersion {
+				delete(versions, p.version)
+			}
+			incomplete = true
+			continue
+		}
+		(*p.pkgVersion)["dist"].(*PackageDist).Shasum = shasum
+	}
+
+	latest := ""
+	for _, version := range order {
+		if versions[version] != nil {
+			latest = version
+		}
+	}
+
 	distTags := PackageDistTags{}
 	if latest != "" {
 		distTags["latest"] = latest
 	}
-	packageRoot := &PackageRoot{name, &distTags, &versions}
+	packageRoot := &PackageRoot{name, &distTags, &versions, incomplete}
 	return packageRoot, nil
 }
 
+// pkgRootETag computes the ETag of a package root document. The document only
+// depends on the repository's tags, identified by their fingerprint, and the
+// base URL of its tarball URLs.
+func pkgRootETag(fingerprint string, base *BaseURL) string {
+	hasher := sha1.New()
+	io.WriteString(hasher, fingerprint+" "+base.String())
+	return `"` + hex.EncodeToString(hasher.Sum(nil)) + `"`
+}
+
 // HandlePackageRoot handles requests to the package root URL.
 // The package root url is the base URL where a client can get top-level
 // information about a package and all of the versions known to the registry.
 // A valid “package root url” response MUST be returned when the client requests
 // {registry root url}/{package name}.
+// Conditional requests are answered without reading the package's versions,
+// and documents are served from the package root cache as long as the
+// repository's tags don't change. Documents with skipped versions are neither
+// cached nor have an ETag, so that they are generated again. Package roots of
+// overlaid packages are neither cached nor have an ETag, since they include the
+// upstream versions.
 // See http://wiki.commonjs.org/wiki/Packages/Registry#package_root_url
 func (r *Registry) HandlePackageRoot(repo *git.Repository,
 	w http.ResponseWriter, req *http.Request) error {
-	name := req.URL.Query().Get(":name")
-	res, err := NewPackageRoot(name, r.config.FrontAddr, repo, r.shaCache)
+	name := getPkgName(req)
+	config := r.getConfig()
+	base := config.baseURL(req)
+	contextLog := util.ContextLog(req, config.Logger)
+	if config.isOverlay(name) {
+		res, err := NewPackageRoot(name, base, repo, r.getShaCache(),
+			r.shasums, contextLog)
+		if err != nil {
+			return err
+		}
+		return r.writeOverlayPkgRoot(w, req, res)
+	}
+
+	fingerprint, err := storage.RefsFingerprint(repo)
 	if err != nil {
 		return err
 	}
-	return util.RespondJSON(w, 200, res)
+	if checkNotModified(w, req, pkgRootETag(fingerprint, base)) {
+		return nil
+	}
+	rootCache := r.getPkgRootCache()
+	if rootCache != nil {
+		if doc, ok := rootCache.Get(name, base, fingerprint); ok {
+			return writePkgRoot(w, doc)
+		}
+	}
+	res, err := NewPackageRoot(name, base, repo, r.getShaCache(),
+		r.shasums, contextLog)
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if res.incomplete {
+		w.Header().Del("ETag")
+	} else if rootCache != nil {
+		if err := rootCache.Add(name, base, fingerprint, doc); err != nil {
+			util.LogWarn(contextLog, err, "failed to cache package root")
+		}
+	}
+	return writePkgRoot(w, doc)
+}
+
+// writePkgRoot writes a serialized package root document.
+func writePkgRoot(w http.ResponseWriter, doc []byte) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(doc)))
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(doc)
+	return err
 }
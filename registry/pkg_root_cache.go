@@ -0,0 +1,168 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/hashicorp/golang-lru"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PkgRootCache caches serialized package root documents of local packages.
+// Documents are stored per package name and base URL together with the
+// fingerprint of the repository's refs they have been built from. Pushing a
+// tag changes the fingerprint, so that outdated documents are never served.
+//
+// If Dir is set, documents are additionally stored on disk and survive
+// restarts.
+type PkgRootCache struct {
+	Dir string
+	lru *lru.Cache
+}
+
+// pkgRootCacheEntry is a cached package root document.
+type pkgRootCacheEntry struct {
+	fingerprint string
+	doc         []byte
+}
+
+// NewPkgRootCache creates a new package root cache holding up to size
+// documents in memory. dir is optional.
+func NewPkgRootCache(size int, dir string) (*PkgRootCache, error) {
+	lru, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	return &PkgRootCache{dir, lru}, nil
+}
+
+// Get returns the cached document of the named package, if it has been built
+// from the refs identified by fingerprint.
+func (c *PkgRootCache) Get(name string, base *BaseURL,
+	fingerprint string) ([]byte, bool) {
+	key := pkgRootCacheKey(name, base)
+	if value, ok := c.lru.Get(key); ok {
+		entry := value.(*pkgRootCacheEntry)
+		if entry.fingerprint == fingerprint {
+			return entry.doc, true
+		}
+		return nil, false
+	}
+	if c.Dir == "" {
+		return nil, false
+	}
+	entry, err := c.load(key)
+	if err != nil || entry.fingerprint != fingerprint {
+		return nil, false
+	}
+	c.lru.Add(key, entry)
+	return entry.doc, true
+}
+
+// Add caches the document of the named package that has been built from the
+// refs identified by fingerprint. It replaces any previous document.
+func (c *PkgRootCache) Add(name string, base *BaseURL, fingerprint string,
+	doc []byte) error {
+	key := pkgRootCacheKey(name, base)
+	entry := &pkgRootCacheEntry{fingerprint, doc}
+	c.lru.Add(key, entry)
+	if c.Dir == "" {
+		return nil
+	}
+	return c.save(key, entry)
+}
+
+// Remove drops all cached documents of the named package.
+func (c *PkgRootCache) Remove(name string) {
+	prefix := name + " "
+	for _, key := range c.lru.Keys() {
+		key := key.(string)
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		c.lru.Remove(key)
+		if c.Dir != "" {
+			os.Remove(c.path(key))
+		}
+	}
+}
+
+// pkgRootCacheKey returns the cache key of a package root document.
+func pkgRootCacheKey(name string, base *BaseURL) string {
+	return name + " " + base.String()
+}
+
+// path returns the path of the file storing the document with the given key.
+func (c *PkgRootCache) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+	return filepath.Join(c.Dir, hash[:2], hash+".json")
+}
+
+// load reads a document from disk. The first line of the file is the
+// fingerprint, the remainder the document.
+func (c *PkgRootCache) load(key string) (*pkgRootCacheEntry, error) {
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, os.ErrNotExist
+	}
+	return &pkgRootCacheEntry{string(data[:i]), data[i+1:]}, nil
+}
+
+// save atomically writes a document to disk.
+func (c *PkgRootCache) save(key string, entry *pkgRootCacheEntry) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".root")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(entry.fingerprint + "\n")
+	if err == nil {
+		_, err = tmp.Write(entry.doc)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
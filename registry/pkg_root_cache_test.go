@@ -0,0 +1,218 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"github.com/alexanderGugel/nerva/storage"
+	"github.com/libgit2/git2go"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createPkgRootCache(size int, dir string, t *testing.T) *PkgRootCache {
+	cache, err := NewPkgRootCache(size, dir)
+	if err != nil {
+		t.Fatalf("NewPkgRootCache(%v, %q) failed: %v", size, dir, err)
+	}
+	return cache
+}
+
+func TestPkgRootCache(t *testing.T) {
+	base := createBaseURL("http://127.0.0.1:8200", t)
+	other := createBaseURL("https://tools.corp/npm", t)
+	cache := createPkgRootCache(2, "", t)
+
+	if _, ok := cache.Get("tape", base, "a"); ok {
+		t.Errorf("cache.Get() on empty cache = _, true; want false")
+	}
+	if err := cache.Add("tape", base, "a", []byte(`{"name":"tape"}`)); err != nil {
+		t.Fatalf("cache.Add() failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		base        *BaseURL
+		fingerprint string
+		ok          bool
+	}{
+		{"tape", base, "a", true},
+		{"tape", base, "b", false},
+		{"tape", other, "a", false},
+		{"ied", base, "a", false},
+	}
+	for _, tt := range tests {
+		doc, ok := cache.Get(tt.name, tt.base, tt.fingerprint)
+		if ok != tt.ok {
+			t.Errorf("cache.Get(%v, %v, %v) = _, %v; want %v", tt.name, tt.base, tt.fingerprint, ok, tt.ok)
+		}
+		if ok && string(doc) != `{"name":"tape"}` {
+			t.Errorf("cache.Get(%v, %v, %v) = %s; want %s", tt.name, tt.base, tt.fingerprint, doc, `{"name":"tape"}`)
+		}
+	}
+
+	// A new fingerprint replaces the previous document.
+	cache.Add("tape", base, "b", []byte(`{"name":"tape","v":2}`))
+	if _, ok := cache.Get("tape", base, "a"); ok {
+		t.Errorf("cache.Get() of replaced document = _, true; want false")
+	}
+	if doc, ok := cache.Get("tape", base, "b"); !ok || string(doc) != `{"name":"tape","v":2}` {
+		t.Errorf("cache.Get() = %s, %v; want %s, true", doc, ok, `{"name":"tape","v":2}`)
+	}
+}
+
+func TestPkgRootCacheRemove(t *testing.T) {
+	base := createBaseURL("http://127.0.0.1:8200", t)
+	other := createBaseURL("https://tools.corp/npm", t)
+	cache := createPkgRootCache(10, "", t)
+	cache.Add("tape", base, "a", []byte("{}"))
+	cache.Add("tape", other, "a", []byte("{}"))
+	cache.Add("tape-extra", base, "a", []byte("{}"))
+
+	cache.Remove("tape")
+	for _, b := range []*BaseURL{base, other} {
+		if _, ok := cache.Get("tape", b, "a"); ok {
+			t.Errorf("cache.Get(tape, %v) after Remove = _, true; want false", b)
+		}
+	}
+	if _, ok := cache.Get("tape-extra", base, "a"); !ok {
+		t.Errorf("cache.Get(tape-extra) after Remove(tape) = _, false; want true")
+	}
+}
+
+func TestPkgRootCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkg_root_cache_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	base := createBaseURL("http://127.0.0.1:8200", t)
+
+	cache := createPkgRootCache(1, dir, t)
+	if err := cache.Add("tape", base, "a", []byte(`{"name":"tape"}`)); err != nil {
+		t.Fatalf("cache.Add() failed: %v", err)
+	}
+	// Evicts "tape" from memory.
+	if err := cache.Add("ied", base, "a", []byte(`{"name":"ied"}`)); err != nil {
+		t.Fatalf("cache.Add() failed: %v", err)
+	}
+
+	for _, cache := range []*PkgRootCache{cache, createPkgRootCache(1, dir, t)} {
+		if doc, ok := cache.Get("tape", base, "a"); !ok || string(doc) != `{"name":"tape"}` {
+			t.Errorf("cache.Get() = %s, %v; want %s, true", doc, ok, `{"name":"tape"}`)
+		}
+		if _, ok := cache.Get("tape", base, "b"); ok {
+			t.Errorf("cache.Get() with outdated fingerprint = _, true; want false")
+		}
+	}
+}
+
+func TestHandlePackageRootCached(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	config := *r.config
+	config.NoUpstream = true
+	if err := r.Reload(&config); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+	dir := filepath.Join(config.StorageDir, "tape")
+	repo, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("git.InitRepository(%v) failed: %v", dir, err)
+	}
+	fingerprint, err := storage.RefsFingerprint(repo)
+	if err != nil {
+		t.Fatalf("storage.RefsFingerprint() failed: %v", err)
+	}
+	doc := `{"name":"tape","cached":true}`
+	r.getPkgRootCache().Add("tape", config.frontURL(), fingerprint, []byte(doc))
+
+	w := httptest.NewRecorder()
+	makePkgRootEndpoint(r)(w, httptest.NewRequest("GET", "/tape?:name=tape", nil))
+	if w.Code != http.StatusOK || w.Body.String() != doc {
+		t.Errorf("GET /tape = %v, %s; want %v, %s", w.Code, w.Body, http.StatusOK, doc)
+	}
+
+	next := config
+	next.PkgRootCacheSize = 0
+	if err := r.Reload(&next); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+	w = httptest.NewRecorder()
+	makePkgRootEndpoint(r)(w, httptest.NewRequest("GET", "/tape?:name=tape", nil))
+	if w.Code != http.StatusOK || w.Body.String() == doc {
+		t.Errorf("GET /tape without cache = %v, %s; want %v and a new document", w.Code, w.Body, http.StatusOK)
+	}
+}
+
+func TestHandlePackageRootIncomplete(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	config := *r.config
+	config.NoUpstream = true
+	if err := r.Reload(&config); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+	dir := filepath.Join(config.StorageDir, "tape")
+	repo, err := git.InitRepository(dir, true)
+	if err != nil {
+		t.Fatalf("git.InitRepository(%v) failed: %v", dir, err)
+	}
+	// Versions that don't point to a tree are skipped.
+	id, err := repo.CreateBlobFromBuffer([]byte("tape"))
+	if err != nil {
+		t.Fatalf("repo.CreateBlobFromBuffer() failed: %v", err)
+	}
+	if _, err := repo.References.Create("refs/tags/v1.0.0", id, false, ""); err != nil {
+		t.Fatalf("repo.References.Create() failed: %v", err)
+	}
+	fingerprint, err := storage.RefsFingerprint(repo)
+	if err != nil {
+		t.Fatalf("storage.RefsFingerprint() failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	makePkgRootEndpoint(r)(w, httptest.NewRequest("GET", "/tape?:name=tape", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /tape code = %v; want %v", w.Code, http.StatusOK)
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		t.Errorf("GET /tape ETag = %v; want none", etag)
+	}
+	if _, ok := r.getPkgRootCache().Get("tape", config.frontURL(), fingerprint); ok {
+		t.Errorf("r.getPkgRootCache().Get(tape) = _, true; want false")
+	}
+}
+
+func TestRegistryPkgChanged(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	base := r.config.frontURL()
+	r.getPkgRootCache().Add("tape", base, "a", []byte("{}"))
+
+	r.Events().Publish(storage.Event{Name: "tape"})
+	if _, ok := r.getPkgRootCache().Get("tape", base, "a"); ok {
+		t.Errorf("package root of changed package is still cached")
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/semver"
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexanderGugel/nerva/util"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PolicyAllow allows packages matching a rule.
+	PolicyAllow = "allow"
+
+	// PolicyDeny blocks packages matching a rule.
+	PolicyDeny = "deny"
+)
+
+// policyCheckInterval is the minimum interval in which policy files are
+// checked for changes.
+const policyCheckInterval = time.Second
+
+// PolicyRule allows or denies upstream packages. A rule applies to a version
+// of a package if all of its criteria match: Name is a glob pattern as
+// supported by path.Match, Versions a semver range (e.g. "< 1.2.3") and
+// License a list of SPDX license identifiers. Empty criteria match anything.
+//
+// Ranges only contain prereleases if they say so (e.g. ">= 1.0.0-0"), but deny
+// rules also apply to the prereleases of the versions they match.
+type PolicyRule struct {
+	Action   string   `json:"action"`
+	Name     string   `json:"name,omitempty"`
+	Versions string   `json:"versions,omitempty"`
+	License  []string `json:"license,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+
+	constraints *semver.Constraints
+}
+
+// Policy decides which packages of upstream registries may be installed. The
+// first matching rule wins. If no rule matches, Default applies, which allows
+// all packages unless set to PolicyDeny.
+type Policy struct {
+	Default string        `json:"default,omitempty"`
+	Rules   []*PolicyRule `json:"rules"`
+}
+
+// LoadPolicy reads a policy from the JSON file at path.
+func LoadPolicy(path string) (*Policy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	policy := &Policy{}
+	if err := json.NewDecoder(file).Decode(policy); err != nil {
+		return nil, fmt.Errorf("invalid policy %v: %v", path, err)
+	}
+	if err := policy.init(); err != nil {
+		return nil, fmt.Errorf("invalid policy %v: %v", path, err)
+	}
+	return policy, nil
+}
+
+// init validates the policy and compiles its version ranges.
+func (p *Policy) init() error {
+	switch p.Default {
+	case "", PolicyAllow, PolicyDeny:
+	default:
+		return fmt.Errorf("invalid default %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		switch rule.Action {
+		case PolicyAllow, PolicyDeny:
+		default:
+			return fmt.Errorf("rule %d: invalid action %q", i, rule.Action)
+		}
+		if _, err := path.Match(rule.Name, ""); err != nil {
+			return fmt.Errorf("rule %d: invalid name %q: %v", i, rule.Name, err)
+		}
+		if rule.Versions != "" {
+			constraints, err := semver.NewConstraint(rule.Versions)
+			if err != nil {
+				return fmt.Errorf("rule %d: invalid versions %q: %v", i,
+					rule.Versions, err)
+			}
+			rule.constraints = constraints
+		}
+	}
+	return nil
+}
+
+// matches checks if the rule applies to the supplied version of a package.
+// An empty version or license never matches the respective criterion.
+func (r *PolicyRule) matches(name, version, license string) bool {
+	if r.Name != "" && !matchName([]string{r.Name}, name) {
+		return false
+	}
+	if r.constraints != nil {
+		v, err := semver.NewVersion(version)
+		if err != nil || !r.checkVersion(v) {
+			return false
+		}
+	}
+	if len(r.License) > 0 {
+		found := false
+		for _, l := range r.License {
+			if license != "" && strings.EqualFold(l, license) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checkVersion checks if v is within the rule's range. Prereleases of
+// versions within the range of a deny rule are denied as well, so that a
+// denied range can't be circumvented by installing a prerelease.
+func (r *PolicyRule) checkVersion(v *semver.Version) bool {
+	if r.constraints.Check(v) {
+		return true
+	}
+	if r.Action != PolicyDeny || v.Prerelease() == "" {
+		return false
+	}
+	release, err := semver.NewVersion(fmt.Sprintf("%d.%d.%d", v.Major(),
+		v.Minor(), v.Patch()))
+	return err == nil && r.constraints.Check(release)
+}
+
+// Check returns the rule denying the supplied version of a package, or nil if
+// it is allowed. If the package is denied by default, the returned rule has no
+// criteria.
+func (p *Policy) Check(name, version, license string) *PolicyRule {
+	for _, rule := range p.Rules {
+		if !rule.matches(name, version, license) {
+			continue
+		}
+		if rule.Action == PolicyDeny {
+			return rule
+		}
+		return nil
+	}
+	if p.Default == PolicyDeny {
+		return &PolicyRule{Action: PolicyDeny, Reason: "denied by default"}
+	}
+	return nil
+}
+
+// needsLicense checks if the license of a package is required for deciding
+// whether it is allowed.
+func (p *Policy) needsLicense(name string) bool {
+	for _, rule := range p.Rules {
+		if len(rule.License) > 0 &&
+			(rule.Name == "" || matchName([]string{rule.Name}, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsVersion checks if the version of a package is required for deciding
+// whether it is allowed.
+func (p *Policy) needsVersion(name string) bool {
+	for _, rule := range p.Rules {
+		if rule.Versions != "" &&
+			(rule.Name == "" || matchName([]string{rule.Name}, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterPkgRoot removes all denied versions from the supplied package root
+// document, along with dist-tags and timestamps referring to them. It returns
+// the removed versions and the rules that denied them.
+func (p *Policy) FilterPkgRoot(doc map[string]interface{}, name string) map[string]*PolicyRule {
+	denied := map[string]*PolicyRule{}
+	versions, ok := doc["versions"].(map[string]interface{})
+	if !ok {
+		return denied
+	}
+	for version, versionDoc := range versions {
+		versionDoc, _ := versionDoc.(map[string]interface{})
+		if rule := p.Check(name, version, getLicense(versionDoc)); rule != nil {
+			denied[version] = rule
+			delete(versions, version)
+		}
+	}
+	if len(denied) == 0 {
+		return denied
+	}
+	for _, key := range []string{"dist-tags", "time"} {
+		entries, ok := doc[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for tag, value := range entries {
+			if version, ok := value.(string); ok && denied[version] != nil {
+				delete(entries, tag)
+			}
+			if denied[tag] != nil {
+				delete(entries, tag)
+			}
+		}
+	}
+	return denied
+}
+
+// getLicense returns the license of a version document. Both SPDX expressions
+// and the legacy object format ({"type": "MIT"}) are supported.
+func getLicense(versionDoc map[string]interface{}) string {
+	switch license := versionDoc["license"].(type) {
+	case string:
+		return license
+	case map[string]interface{}:
+		if licenseType, ok := license["type"].(string); ok {
+			return licenseType
+		}
+	}
+	return ""
+}
+
+// PolicyFile is a policy that is reloaded whenever the underlying file
+// changes. Changes are detected lazily based on the file's modification time.
+type PolicyFile struct {
+	Path   string
+	logger *log.Logger
+
+	mu        sync.Mutex
+	policy    *Policy
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// NewPolicyFile loads the policy at path.
+func NewPolicyFile(path string, logger *log.Logger) (*PolicyFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyFile{
+		Path:      path,
+		logger:    logger,
+		policy:    policy,
+		modTime:   info.ModTime(),
+		checkedAt: time.Now(),
+	}, nil
+}
+
+// Policy returns the current policy. If the file has been modified, it is
+// reloaded first. Invalid policies are logged and ignored, so that the
+// previous policy stays in effect.
+func (f *PolicyFile) Policy() *Policy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checkedAt) < policyCheckInterval {
+		return f.policy
+	}
+	f.checkedAt = time.Now()
+
+	contextLog := f.logger.WithField("path", f.Path)
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		util.LogErr(contextLog, err, "failed to check policy")
+		return f.policy
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return f.policy
+	}
+	f.modTime = info.ModTime()
+	policy, err := LoadPolicy(f.Path)
+	if err != nil {
+		util.LogErr(contextLog, err, "failed to reload policy")
+		return f.policy
+	}
+	f.policy = policy
+	contextLog.Info("reloaded policy")
+	return f.policy
+}
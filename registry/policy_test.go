@@ -0,0 +1,171 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func createPolicy(policy *Policy, t *testing.T) *Policy {
+	if err := policy.init(); err != nil {
+		t.Fatalf("policy.init() failed: %v", err)
+	}
+	return policy
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := createPolicy(&Policy{
+		Rules: []*PolicyRule{
+			{Action: PolicyDeny, Name: "event-stream", Versions: "3.3.6", Reason: "malware"},
+			{Action: PolicyAllow, Name: "@ourcompany/*"},
+			{Action: PolicyDeny, License: []string{"AGPL-3.0"}, Reason: "license"},
+		},
+	}, t)
+
+	tests := []struct {
+		name, version, license string
+		denied                 bool
+	}{
+		{"event-stream", "3.3.6", "MIT", true},
+		{"event-stream", "3.3.5", "MIT", false},
+		{"event-stream", "3.3.6-beta.1", "MIT", true},
+		{"event-stream", "3.3.5-beta.1", "MIT", false},
+		{"event-stream", "latest", "MIT", false},
+		{"tape", "1.0.0", "agpl-3.0", true},
+		{"tape", "1.0.0", "MIT", false},
+		{"tape", "1.0.0", "", false},
+		{"@ourcompany/tape", "1.0.0", "AGPL-3.0", false},
+	}
+	for _, tt := range tests {
+		rule := policy.Check(tt.name, tt.version, tt.license)
+		if denied := rule != nil; denied != tt.denied {
+			t.Errorf("policy.Check(%q, %q, %q) denied = %t; want %t", tt.name, tt.version, tt.license, denied, tt.denied)
+		}
+	}
+
+	policy = createPolicy(&Policy{
+		Default: PolicyDeny,
+		Rules:   []*PolicyRule{{Action: PolicyAllow, Name: "tape"}},
+	}, t)
+	if rule := policy.Check("tape", "1.0.0", ""); rule != nil {
+		t.Errorf("policy.Check(%q) = %v; want nil", "tape", rule)
+	}
+	if rule := policy.Check("ied", "1.0.0", ""); rule == nil {
+		t.Errorf("policy.Check(%q) = nil; want denied by default", "ied")
+	}
+
+	// Allow rules don't extend to prereleases.
+	policy = createPolicy(&Policy{
+		Default: PolicyDeny,
+		Rules:   []*PolicyRule{{Action: PolicyAllow, Versions: "^1.0.0"}},
+	}, t)
+	if rule := policy.Check("tape", "1.1.0-beta.1", ""); rule == nil {
+		t.Errorf("policy.Check(%q, %q) = nil; want denied by default", "tape", "1.1.0-beta.1")
+	}
+}
+
+func TestPolicyInit(t *testing.T) {
+	invalid := []*Policy{
+		{Default: "maybe"},
+		{Rules: []*PolicyRule{{Action: "block"}}},
+		{Rules: []*PolicyRule{{Action: PolicyDeny, Name: "[tape"}}},
+		{Rules: []*PolicyRule{{Action: PolicyDeny, Versions: "not a range"}}},
+	}
+	for _, policy := range invalid {
+		if err := policy.init(); err == nil {
+			t.Errorf("policy.init() = nil; want error for %+v", policy)
+		}
+	}
+}
+
+func TestPolicyFilterPkgRoot(t *testing.T) {
+	policy := createPolicy(&Policy{
+		Rules: []*PolicyRule{
+			{Action: PolicyDeny, Versions: ">= 2.0.0"},
+			{Action: PolicyDeny, License: []string{"GPL-3.0"}},
+		},
+	}, t)
+	doc := map[string]interface{}{
+		"dist-tags": map[string]interface{}{"latest": "2.0.0", "stable": "1.0.0"},
+		"time":      map[string]interface{}{"1.0.0": "2016", "1.1.0": "2016", "2.0.0": "2017"},
+		"versions": map[string]interface{}{
+			"1.0.0": map[string]interface{}{"license": "MIT"},
+			"1.1.0": map[string]interface{}{"license": map[string]interface{}{"type": "GPL-3.0"}},
+			"2.0.0": map[string]interface{}{"license": "MIT"},
+		},
+	}
+
+	denied := policy.FilterPkgRoot(doc, "tape")
+	if len(denied) != 2 || denied["1.1.0"] == nil || denied["2.0.0"] == nil {
+		t.Errorf("policy.FilterPkgRoot() denied = %v; want 1.1.0 and 2.0.0", denied)
+	}
+	want := map[string]interface{}{
+		"dist-tags": map[string]interface{}{"stable": "1.0.0"},
+		"time":      map[string]interface{}{"1.0.0": "2016"},
+		"versions": map[string]interface{}{
+			"1.0.0": map[string]interface{}{"license": "MIT"},
+		},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("policy.FilterPkgRoot() doc = %v; want %v", doc, want)
+	}
+}
+
+func TestPolicyFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerva-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+	write := func(contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"rules": [{"action": "deny", "name": "tape"}]}`)
+	policyFile, err := NewPolicyFile(path, DefaultConfig().Logger)
+	if err != nil {
+		t.Fatalf("NewPolicyFile() failed: %v", err)
+	}
+	if rule := policyFile.Policy().Check("tape", "1.0.0", ""); rule == nil {
+		t.Errorf("policy.Check(%q) = nil; want denied", "tape")
+	}
+
+	write(`{"rules": [{"action": "deny", "name": "ied"}]}`)
+	policyFile.checkedAt = policyFile.checkedAt.Add(-policyCheckInterval)
+	policyFile.modTime = policyFile.modTime.Add(-policyCheckInterval)
+	if rule := policyFile.Policy().Check("tape", "1.0.0", ""); rule != nil {
+		t.Errorf("policy.Check(%q) = %v; want nil after reload", "tape", rule)
+	}
+
+	write(`{"rules": [{"action": "block"}]}`)
+	policyFile.checkedAt = policyFile.checkedAt.Add(-policyCheckInterval)
+	policyFile.modTime = policyFile.modTime.Add(-policyCheckInterval)
+	if rule := policyFile.Policy().Check("ied", "1.0.0", ""); rule == nil {
+		t.Errorf("policy.Check(%q) = nil; want previous policy to stay in effect", "ied")
+	}
+}
@@ -23,22 +23,40 @@
 package registry
 
 import (
+	"context"
+	"crypto/tls"
 	log "github.com/Sirupsen/logrus"
 	"github.com/alexanderGugel/nerva/storage"
 	"github.com/alexanderGugel/nerva/util"
 	"github.com/bmizerany/pat"
 	"github.com/libgit2/git2go"
+	"net"
 	"net/http"
+	"sync"
 )
 
 // Registry represents an Common JS registry server. A Registry does exposes a
 // router, which can be bound to an arbitrary socket.
 type Registry struct {
-	config   *Config
-	mux      *pat.PatternServeMux
-	storage  *storage.Storage
-	upstream *Upstream
-	shaCache *storage.ShaCache
+	config    *Config
+	mux       *pat.PatternServeMux
+	storage   *storage.Storage
+	upstreams Upstreams
+	shaCache  *storage.ShaCache
+	rootCache *PkgRootCache
+	policy    *PolicyFile
+	auditor   *Auditor
+	events    *storage.Bus
+	watcher   *storage.Watcher
+	shasums   *ShasumPool
+
+	// state guards the parts of the registry that can be swapped on reload.
+	state    sync.RWMutex
+	reloadMu sync.Mutex
+
+	mu       sync.Mutex
+	server   *http.Server
+	listener net.Listener
 }
 
 // New create a new CommonJS registry.
@@ -60,8 +78,13 @@ func New(config *Config) (*Registry, error) {
 func (r *Registry) init() error {
 	initFns := []func() error{
 		r.initShaCache,
-		r.initUpstream,
+		r.initPkgRootCache,
+		r.initUpstreams,
+		r.initPolicy,
+		r.initAuditor,
 		r.initStorage,
+		r.initShasumPool,
+		r.initWatcher,
 		r.initRouter,
 	}
 	for _, f := range initFns {
@@ -72,22 +95,112 @@ func (r *Registry) init() error {
 	return nil
 }
 
-// Start starts the registry.
-func (r *Registry) Start() error {
-	r.config.Logger.WithFields(log.Fields{
-		"config": *r.config,
+// Listen binds the registry to the configured address. Listen is called by
+// Start if necessary, but can be used for binding to port 0 and retrieving the
+// actual address via Addr before serving.
+func (r *Registry) Listen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.listener != nil {
+		return nil
+	}
+	config := r.getConfig()
+	if config.shouldUseTLS() {
+		// Fail early instead of when serving the first connection.
+		if _, err := tls.LoadX509KeyPair(config.CertFile,
+			config.KeyFile); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+	r.listener = listener
+	r.server = &http.Server{Handler: mountHandler(r.prefix, r.mux)}
+	return nil
+}
+
+// Addr returns the address the registry is bound to, or nil if it isn't
+// listening yet.
+func (r *Registry) Addr() net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.listener == nil {
+		return nil
+	}
+	return r.listener.Addr()
+}
+
+// Start starts the registry and blocks until it has been shut down, either via
+// Shutdown or by cancelling ctx. In the latter case in-flight requests are
+// drained for at most ShutdownTimeout.
+func (r *Registry) Start(ctx context.Context) error {
+	config := r.getConfig()
+	config.Logger.WithFields(log.Fields{
+		"config": *config,
 	}).Info("starting registry")
-	server := &http.Server{
-		Addr:    r.config.Addr,
-		Handler: r.mux,
+	if err := r.Listen(); err != nil {
+		return err
 	}
-	if r.config.shouldUseTLS() {
-		server.ListenAndServeTLS(
-			r.config.CertFile,
-			r.config.KeyFile,
-		)
+
+	r.mu.Lock()
+	server, listener := r.server, r.listener
+	r.mu.Unlock()
+
+	config.Logger.WithFields(log.Fields{
+		"addr": listener.Addr().String(),
+	}).Info("listening")
+
+	errc := make(chan error, 1)
+	go func() {
+		if config.shouldUseTLS() {
+			errc <- server.ServeTLS(listener, config.CertFile, config.KeyFile)
+			return
+		}
+		errc <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errc:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(),
+		r.getConfig().ShutdownTimeout)
+	defer cancel()
+	return r.Shutdown(shutdownCtx)
+}
+
+// Shutdown gracefully shuts down the registry without interrupting in-flight
+// requests, such as ongoing downloads.
+func (r *Registry) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	server, listener := r.server, r.listener
+	r.mu.Unlock()
+	// In-flight requests may still wait for shasums and fetch from the
+	// upstreams, so these are only closed once the server has been shut down.
+	// Health checks are started by New, even if the registry isn't started.
+	defer func() {
+		if r.watcher != nil {
+			r.watcher.Close()
+		}
+		if r.shasums != nil {
+			r.shasums.Close()
+		}
+		r.getUpstreams().Close()
+	}()
+	if server == nil {
+		return nil
 	}
-	return server.ListenAndServe()
+	r.getConfig().Logger.Info("shutting down registry")
+	// The listener isn't tracked by the server if Start hasn't been called.
+	listener.Close()
+	return server.Shutdown(ctx)
 }
 
 func (r *Registry) initShaCache() error {
@@ -96,9 +209,60 @@ func (r *Registry) initShaCache() error {
 	return err
 }
 
-func (r *Registry) initUpstream() error {
-	upstream, err := NewUpstream(r.config.UpstreamURL)
-	r.upstream = upstream
+func (r *Registry) initPkgRootCache() error {
+	rootCache, err := newPkgRootCache(r.config)
+	r.rootCache = rootCache
+	return err
+}
+
+// newPkgRootCache creates the package root cache of the supplied config, if
+// enabled.
+func newPkgRootCache(config *Config) (*PkgRootCache, error) {
+	if config.PkgRootCacheSize == 0 {
+		return nil, nil
+	}
+	return NewPkgRootCache(config.PkgRootCacheSize, config.PkgRootCacheDir)
+}
+
+func (r *Registry) initUpstreams() error {
+	upstreams, err := newUpstreams(r.config)
+	r.upstreams = upstreams
+	return err
+}
+
+// newUpstreams creates the upstream registries described by the supplied
+// config.
+func newUpstreams(config *Config) (Upstreams, error) {
+	var cache *UpstreamCache
+	if config.UpstreamCacheDir != "" {
+		var err error
+		cache, err = NewUpstreamCache(config.UpstreamCacheDir,
+			config.UpstreamCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		cache.StaleWhileRevalidate = config.UpstreamStaleWhileRevalidate
+	}
+	return NewUpstreams(config.upstreamConfigs(), cache)
+}
+
+func (r *Registry) initPolicy() error {
+	policy, err := newPolicyFile(r.config)
+	r.policy = policy
+	return err
+}
+
+// newPolicyFile loads the policy file of the supplied config, if any.
+func newPolicyFile(config *Config) (*PolicyFile, error) {
+	if config.PolicyFile == "" {
+		return nil, nil
+	}
+	return NewPolicyFile(config.PolicyFile, config.Logger)
+}
+
+func (r *Registry) initAuditor() error {
+	auditor, err := NewAuditor(r.config.AuditLogFile, r.config.Logger)
+	r.auditor = auditor
 	return err
 }
 
@@ -108,23 +272,176 @@ func (r *Registry) initStorage() error {
 	return err
 }
 
+// initShasumPool starts the workers computing the shasums of tarballs, if
+// enabled, and warms up the SHA cache in the background.
+func (r *Registry) initShasumPool() error {
+	if r.config.ShasumWorkers == 0 {
+		return nil
+	}
+	r.shasums = NewShasumPool(r.config.ShasumWorkers, r.computeShasum)
+	contextLog := r.config.Logger.WithFields(log.Fields{
+		"storageDir": r.config.StorageDir,
+	})
+	go func() {
+		names, err := r.storage.Ls()
+		if err != nil {
+			util.LogWarn(contextLog, err, "failed to list packages for warm-up")
+			return
+		}
+		if err := r.warmUp(names); err != nil {
+			util.LogWarn(contextLog, err, "failed to warm up SHA cache")
+		}
+	}()
+	return nil
+}
+
+// computeShasum computes the shasum of a tarball and adds it to the SHA cache.
+func (r *Registry) computeShasum(name string, id git.Oid) (string, error) {
+	repo, err := r.storage.GetRepo(name)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Free()
+	shasum, size, err := computeShasum(repo, &id)
+	if err != nil {
+		return "", err
+	}
+	r.getShaCache().Add(id, shasum, size)
+	return shasum, nil
+}
+
+// warmUp queues the computation of all uncached shasums of the named
+// packages. It blocks while the queue of the shasum pool is full. Packages
+// that can't be read don't stop the warm-up of the others, but the first
+// error is returned. Packages that have been removed in the meantime are
+// skipped.
+func (r *Registry) warmUp(names []string) error {
+	var firstErr error
+	for _, name := range names {
+		if r.shasums.closed() {
+			return errShasumPoolClosed
+		}
+		ids, err := r.uncachedVersions(name)
+		if storage.Kind(err) == storage.ErrPackageNotFound {
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, id := range ids {
+			r.shasums.Prefetch(name, id)
+		}
+	}
+	return firstErr
+}
+
+// uncachedVersions returns the object ids of the versions of a package whose
+// shasums aren't cached.
+func (r *Registry) uncachedVersions(name string) ([]git.Oid, error) {
+	repo, err := r.storage.GetRepo(name)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+	shaCache := r.getShaCache()
+	ids := []git.Oid{}
+	err = repo.Tags.Foreach(func(tagRef string, id *git.Oid) error {
+		if _, ok := shaCache.Get(*id); !ok &&
+			versionTagRef.MatchString(tagRef) {
+			ids = append(ids, *id)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// initWatcher starts watching the storage directory for changed packages, if
+// enabled.
+func (r *Registry) initWatcher() error {
+	r.events = storage.NewBus()
+	r.events.Subscribe(r.handlePkgChanged)
+	if !r.config.WatchStorage {
+		return nil
+	}
+	contextLog := r.config.Logger.WithFields(log.Fields{
+		"storageDir": r.config.StorageDir,
+	})
+	watcher, err := storage.NewWatcher(r.storage, r.events,
+		r.config.StorageRescanInterval, func(err error) {
+			util.LogWarn(contextLog, err, "failed to watch storage")
+		})
+	r.watcher = watcher
+	return err
+}
+
+// Events returns the bus on which changes to local packages are published.
+func (r *Registry) Events() *storage.Bus {
+	return r.events
+}
+
+// handlePkgChanged drops cached data of a changed package.
+func (r *Registry) handlePkgChanged(e storage.Event) {
+	r.getConfig().Logger.WithFields(log.Fields{
+		"package": e.Name,
+		"removed": e.Removed,
+	}).Debug("package changed")
+	if rootCache := r.getPkgRootCache(); rootCache != nil {
+		rootCache.Remove(e.Name)
+	}
+	if r.shasums != nil && !e.Removed {
+		go func() {
+			if err := r.warmUp([]string{e.Name}); err != nil {
+				contextLog := r.getConfig().Logger.WithFields(log.Fields{
+					"package": e.Name,
+				})
+				util.LogWarn(contextLog, err, "failed to warm up SHA cache")
+			}
+		}()
+	}
+}
+
 func (r *Registry) initRouter() error {
 	r.mux = pat.New()
 
-	r.mux.Get("/", makeRootEndpoint(r))
+	r.get("/", makeRootEndpoint(r))
 
-	r.mux.Get("/-/ping", makePingEndpoint(r))
-	r.mux.Get("/-/ui", makeUIEndpoint(r))
-	r.mux.Get("/-/stats", makeStatsEndpoint(r))
-	r.mux.Get("/-/upstreams", makeUpstreamsEndpoint(r))
+	r.get("/-/ping", makePingEndpoint(r))
+	r.get("/-/healthz", makeHealthzEndpoint(r))
+	r.get("/-/readyz", makeReadyzEndpoint(r))
+	r.get("/-/ui", makeUIEndpoint(r))
+	r.get("/-/stats", makeStatsEndpoint(r))
+	r.get("/-/upstreams", makeUpstreamsEndpoint(r))
+	r.get("/-/upstream/@:scope/:name/-/", makeUpstreamTarballEndpoint(r))
+	r.get("/-/upstream/:name/-/", makeUpstreamTarballEndpoint(r))
 
-	r.mux.Get("/:name", makePkgRootEndpoint(r))
-	r.mux.Get("/:name/-/:version.tgz", makePkgDownloadEndpoint(r))
-	r.mux.Get("/:name/stats", makePkgStatsEndpoint(r))
+	r.get("/@:scope/:name", makePkgRootEndpoint(r))
+	r.get("/@:scope/:name/-/:version.tgz", makePkgDownloadEndpoint(r))
+	r.get("/@:scope/:name/-/:file", makeUpstreamDownloadEndpoint(r))
+	r.get("/@:scope/:name/stats", makePkgStatsEndpoint(r))
+
+	r.get("/:name", makePkgRootEndpoint(r))
+	r.get("/:name/-/:version.tgz", makePkgDownloadEndpoint(r))
+	r.get("/:name/-/:file", makeUpstreamDownloadEndpoint(r))
+	r.get("/:name/stats", makePkgStatsEndpoint(r))
 
 	return nil
 }
 
+// prefix returns the path prefix nerva is hosted at, as configured via the
+// FrontAddr.
+func (r *Registry) prefix() string {
+	return r.getConfig().frontURL().Prefix()
+}
+
+// get registers the handler for GET requests matching the pattern. All
+// requests are access logged.
+func (r *Registry) get(pattern string, handler http.HandlerFunc) {
+	r.mux.Get(pattern, wrapAccessLog(pattern, handler, r.getConfig))
+}
+
 func makeRootEndpoint(r *Registry) http.HandlerFunc {
 	return wrapErrHandle(r.HandleRoot, r.config.Logger)
 }
@@ -133,6 +450,14 @@ func makePingEndpoint(r *Registry) http.HandlerFunc {
 	return wrapErrHandle(r.HandlePing, r.config.Logger)
 }
 
+func makeHealthzEndpoint(r *Registry) http.HandlerFunc {
+	return wrapErrHandle(r.HandleHealthz, r.config.Logger)
+}
+
+func makeReadyzEndpoint(r *Registry) http.HandlerFunc {
+	return wrapErrHandle(r.HandleReadyz, r.config.Logger)
+}
+
 func makeUIEndpoint(r *Registry) http.HandlerFunc {
 	return wrapErrHandle(r.HandleUI, r.config.Logger)
 }
@@ -147,9 +472,11 @@ func makeUpstreamsEndpoint(r *Registry) http.HandlerFunc {
 
 func makePkgRootEndpoint(r *Registry) http.HandlerFunc {
 	return wrapErrHandle(
-		wrapUpstreamHandle(
-			wrapRepoHandle(r.HandlePackageRoot, r.storage),
-			r.upstream,
+		wrapPkgNameHandle(
+			wrapUpstreamHandle(
+				wrapRepoHandle(r.HandlePackageRoot, r.storage),
+				r,
+			),
 		),
 		r.config.Logger,
 	)
@@ -157,17 +484,35 @@ func makePkgRootEndpoint(r *Registry) http.HandlerFunc {
 
 func makePkgDownloadEndpoint(r *Registry) http.HandlerFunc {
 	return wrapErrHandle(
-		wrapUpstreamHandle(
-			wrapRepoHandle(r.HandlePkgDownload, r.storage),
-			r.upstream,
+		wrapPkgNameHandle(
+			wrapUpstreamHandle(
+				wrapRepoHandle(r.HandlePkgDownload, r.storage),
+				r,
+			),
 		),
 		r.config.Logger,
 	)
 }
 
+func makeUpstreamDownloadEndpoint(r *Registry) http.HandlerFunc {
+	return wrapErrHandle(
+		wrapPkgNameHandle(r.HandleUpstreamDownload),
+		r.config.Logger,
+	)
+}
+
+func makeUpstreamTarballEndpoint(r *Registry) http.HandlerFunc {
+	return wrapErrHandle(
+		wrapPkgNameHandle(r.HandleUpstreamTarball),
+		r.config.Logger,
+	)
+}
+
 func makePkgStatsEndpoint(r *Registry) http.HandlerFunc {
 	return wrapErrHandle(
-		wrapRepoHandle(HandlePkgStats, r.storage),
+		wrapPkgNameHandle(
+			wrapRepoHandle(HandlePkgStats, r.storage),
+		),
 		r.config.Logger,
 	)
 }
@@ -181,24 +526,59 @@ func wrapErrHandle(handler errHandle, logger *log.Logger) http.HandlerFunc {
 		if err == nil {
 			return
 		}
-		contextLog := logger.WithFields(util.GetRequestFields(req))
-		util.LogErr(contextLog, err, "handler failed")
-		code := http.StatusInternalServerError
-		res := &util.ErrorResponse{
-			http.StatusText(code),
-			"unexpected internal error",
+		contextLog := util.ContextLog(req, logger)
+		code, reason := errorStatus(err)
+		if code >= http.StatusInternalServerError {
+			util.LogErr(contextLog, err, "handler failed")
+		} else {
+			contextLog.WithError(err).Debug("handler failed")
 		}
+		res := &util.ErrorResponse{http.StatusText(code), reason}
 		if err := util.RespondJSON(w, code, res); err != nil {
 			util.LogErr(contextLog, err, "failed to write response")
 		}
 	}
 }
 
+// errorStatus maps an error returned by a handler to the HTTP status code and
+// reason of the error response.
+func errorStatus(err error) (int, string) {
+	switch storage.Kind(err) {
+	case storage.ErrPackageNotFound:
+		return http.StatusNotFound, "package not found"
+	case storage.ErrVersionNotFound:
+		return http.StatusNotFound, "version not found"
+	case storage.ErrInvalidName:
+		return http.StatusBadRequest, "invalid package name"
+	case storage.ErrCorruptRepo:
+		return http.StatusInternalServerError, "corrupt repository"
+	}
+	return http.StatusInternalServerError, "unexpected internal error"
+}
+
+// wrapPkgNameHandle rejects requests for invalid package names. It has to wrap
+// all handles of routes with a ":name" parameter. Since all of them read
+// existing packages, legacy package names are accepted.
+func wrapPkgNameHandle(handle errHandle) errHandle {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		name := getPkgName(req)
+		if err := util.ValidateLegacyPkgName(name); err != nil {
+			code := http.StatusBadRequest
+			res := &util.ErrorResponse{
+				http.StatusText(code),
+				"invalid package name: " + err.Error(),
+			}
+			return util.RespondJSON(w, code, res)
+		}
+		return handle(w, req)
+	}
+}
+
 type repoHandle func(*git.Repository, http.ResponseWriter, *http.Request) error
 
 func wrapRepoHandle(handle repoHandle, storage *storage.Storage) errHandle {
 	return func(w http.ResponseWriter, req *http.Request) error {
-		name := req.URL.Query().Get(":name")
+		name := getPkgName(req)
 		repo, err := storage.GetRepo(name)
 		if err != nil {
 			return err
@@ -207,16 +587,25 @@ func wrapRepoHandle(handle repoHandle, storage *storage.Storage) errHandle {
 	}
 }
 
-func wrapUpstreamHandle(handle errHandle, upstream *Upstream) errHandle {
+func wrapUpstreamHandle(handle errHandle, r *Registry) errHandle {
 	return func(w http.ResponseWriter, req *http.Request) error {
 		err := handle(w, req)
 		if err == nil {
 			return nil
 		}
-		if gitErr, ok := err.(*git.GitError); !ok ||
-			gitErr.Class != git.ErrClassOs {
+		if storage.Kind(err) != storage.ErrPackageNotFound {
 			return err
 		}
-		return upstream.HandleReq(w, req)
+		return r.HandleUpstream(w, req)
+	}
+}
+
+// getPkgName returns the (possibly scoped) name of the requested package.
+func getPkgName(req *http.Request) string {
+	query := req.URL.Query()
+	name := query.Get(":name")
+	if scope := query.Get(":scope"); scope != "" {
+		return "@" + scope + "/" + name
 	}
+	return name
 }
@@ -0,0 +1,427 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"github.com/alexanderGugel/nerva/storage"
+	"github.com/libgit2/git2go"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createTestRegistry(t *testing.T) (*Registry, func()) {
+	dir, err := ioutil.TempDir("", "registry_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed: %v", err)
+	}
+	config := DefaultConfig()
+	config.Addr = "127.0.0.1:0"
+	config.StorageDir = dir
+	// Tests mustn't health check the public registry.
+	config.UpstreamHealthInterval = 0
+	r, err := New(config)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("New(%v) failed: %v", config, err)
+	}
+	return r, func() { os.RemoveAll(dir) }
+}
+
+func TestRegistryStartShutdown(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+
+	if err := r.Listen(); err != nil {
+		t.Fatalf("r.Listen() failed: %v", err)
+	}
+	addr := r.Addr()
+	if addr == nil {
+		t.Fatalf("r.Addr() = %v; want not nil", addr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- r.Start(ctx)
+	}()
+
+	res, err := http.Get("http://" + addr.String() + "/-/ping")
+	if err != nil {
+		t.Fatalf("http.Get failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("res.StatusCode = %v; want %v", res.StatusCode, http.StatusOK)
+	}
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("r.Start(ctx) = %v; want %v", err, nil)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("r.Start(ctx) did not return after cancel")
+	}
+
+	if _, err := http.Get("http://" + addr.String() + "/-/ping"); err == nil {
+		t.Errorf("http.Get succeeded after shutdown")
+	}
+}
+
+func TestRegistrySubPath(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	config := *r.config
+	config.FrontAddr = "https://tools.corp/npm/"
+	if err := r.Reload(&config); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+	if err := r.Listen(); err != nil {
+		t.Fatalf("r.Listen() failed: %v", err)
+	}
+	defer r.listener.Close()
+
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"/npm/-/ping", http.StatusOK},
+		{"/-/ping", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("GET %v code = %v; want %v", tt.url, w.Code, tt.code)
+		}
+	}
+}
+
+func TestRegistryShutdownWithoutStart(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	server := createUpstreamServer(http.StatusOK, "{}")
+	defer server.Close()
+	r.upstreams = createUpstreams([]*UpstreamConfig{
+		{URL: server.URL, HealthInterval: time.Hour},
+	}, t)
+
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Errorf("r.Shutdown() failed: %v", err)
+	}
+	if r.upstreams[0].stop != nil {
+		t.Errorf("r.Shutdown() didn't stop the health checks")
+	}
+}
+
+func TestRegistryShutdownPendingShasum(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	r.shasums = NewShasumPool(1, func(name string, id git.Oid) (string, error) {
+		close(started)
+		<-release
+		return "shasum-" + name, nil
+	})
+	r.mux.Get("/-/test/shasum", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		shasum, err := r.shasums.Get("tape", createOid(1)).Wait()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(shasum))
+	}))
+	if err := r.Listen(); err != nil {
+		t.Fatalf("r.Listen() failed: %v", err)
+	}
+	addr := r.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- r.Start(ctx)
+	}()
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		res, err := http.Get("http://" + addr + "/-/test/shasum")
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		resc <- result{res.StatusCode, string(body), err}
+	}()
+	<-started
+
+	// The request is blocked on the job while the registry is shutting down.
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatalf("r.Shutdown() didn't close the listener")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	res := <-resc
+	if res.err != nil || res.code != http.StatusOK || res.body != "shasum-tape" {
+		t.Errorf("GET /-/test/shasum = %v, %q, %v; want %v, %q, nil", res.code, res.body, res.err, http.StatusOK, "shasum-tape")
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("r.Start(ctx) = %v; want %v", err, nil)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("r.Start(ctx) did not return after cancel")
+	}
+}
+
+func TestRegistryStartInvalidTLS(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+
+	r.config.CertFile = "./non_existing.crt"
+	r.config.KeyFile = "./non_existing.key"
+
+	if err := r.Start(context.Background()); err == nil {
+		t.Errorf("r.Start() did not fail")
+	}
+	if addr := r.Addr(); addr != nil {
+		t.Errorf("r.Addr() = %v; want %v", addr, nil)
+	}
+}
+
+func TestRegistryReload(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+
+	config := *r.getConfig()
+	config.UpstreamURL = "http://localhost:8080"
+	config.ShaCacheSize = 10
+	if err := r.Reload(&config); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+
+	if got := r.getUpstreams()[0].URL.String(); got != config.UpstreamURL {
+		t.Errorf("r.getUpstreams()[0].URL = %v; want %v", got, config.UpstreamURL)
+	}
+	if got := r.getConfig(); got != &config {
+		t.Errorf("r.getConfig() = %v; want %v", got, &config)
+	}
+}
+
+func TestRegistryReloadRejected(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+
+	current := r.getConfig()
+	config := *current
+	config.Addr = ":9000"
+	config.UpstreamURL = "http://localhost:8080"
+	if err := r.Reload(&config); err == nil {
+		t.Errorf("r.Reload() did not fail")
+	}
+	if got := r.getConfig(); got != current {
+		t.Errorf("r.getConfig() = %v; want %v", got, current)
+	}
+
+	config = *current
+	config.FrontAddr = ""
+	if err := r.Reload(&config); err == nil {
+		t.Errorf("r.Reload() did not fail")
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   int
+		reason string
+	}{
+		{&storage.Error{Kind: storage.ErrPackageNotFound}, http.StatusNotFound, "package not found"},
+		{&storage.Error{Kind: storage.ErrVersionNotFound}, http.StatusNotFound, "version not found"},
+		{&storage.Error{Kind: storage.ErrCorruptRepo}, http.StatusInternalServerError, "corrupt repository"},
+		{&storage.Error{Kind: storage.ErrInvalidName}, http.StatusBadRequest, "invalid package name"},
+		{os.ErrPermission, http.StatusInternalServerError, "unexpected internal error"},
+	}
+	for _, tt := range tests {
+		code, reason := errorStatus(tt.err)
+		if code != tt.code || reason != tt.reason {
+			t.Errorf("errorStatus(%v) = %v, %q; want %v, %q", tt.err, code, reason, tt.code, tt.reason)
+		}
+	}
+}
+
+func TestWrapUpstreamHandle(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	config := *r.config
+	config.NoUpstream = true
+	if err := r.Reload(&config); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+
+	tests := []struct {
+		err      error
+		upstream bool
+	}{
+		{&storage.Error{Kind: storage.ErrPackageNotFound}, true},
+		{&storage.Error{Kind: storage.ErrVersionNotFound}, false},
+		{&storage.Error{Kind: storage.ErrCorruptRepo}, false},
+		{errors.New("permission denied"), false},
+	}
+	for _, tt := range tests {
+		handle := wrapUpstreamHandle(func(http.ResponseWriter, *http.Request) error {
+			return tt.err
+		}, r)
+		w := httptest.NewRecorder()
+		err := handle(w, httptest.NewRequest("GET", "/tape?:name=tape", nil))
+		if upstream := err == nil; upstream != tt.upstream {
+			t.Errorf("wrapUpstreamHandle(%v) upstream = %v; want %v", tt.err, upstream, tt.upstream)
+		}
+	}
+}
+
+func TestPkgRootEndpointStorageErrors(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	config := *r.config
+	config.NoUpstream = true
+	if err := r.Reload(&config); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+	corrupt := filepath.Join(config.StorageDir, "corrupt")
+	if err := os.Mkdir(corrupt, 0755); err != nil {
+		t.Fatalf("os.Mkdir(%v) failed: %v", corrupt, err)
+	}
+
+	tests := []struct {
+		name string
+		code int
+	}{
+		{"missing", http.StatusNotFound},
+		{"corrupt", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/"+tt.name+"?:name="+tt.name, nil)
+		makePkgRootEndpoint(r)(w, req)
+		if w.Code != tt.code {
+			t.Errorf("GET /%v code = %v; want %v", tt.name, w.Code, tt.code)
+		}
+	}
+}
+
+func TestPkgEndpointsInvalidName(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	config := *r.config
+	config.NoUpstream = true
+	if err := r.Reload(&config); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+
+	endpoints := []http.HandlerFunc{
+		makePkgRootEndpoint(r),
+		makePkgDownloadEndpoint(r),
+		makeUpstreamDownloadEndpoint(r),
+		makePkgStatsEndpoint(r),
+	}
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"/tape?:name=tape", http.StatusNotFound},
+		{"/@scope/tape?:scope=scope&:name=tape", http.StatusNotFound},
+		{"/..?:name=..", http.StatusBadRequest},
+		{"/@../tape?:scope=..&:name=tape", http.StatusBadRequest},
+		{"/@scope/..?:scope=scope&:name=..", http.StatusBadRequest},
+		{"/JSONStream?:name=JSONStream", http.StatusNotFound},
+		{"/ta(pe)?:name=ta(pe)", http.StatusNotFound},
+		{"/@Scope/tape?:scope=Scope&:name=tape", http.StatusBadRequest},
+		{"/ta%20pe?:name=ta%20pe", http.StatusBadRequest},
+		{"/node_modules?:name=node_modules", http.StatusBadRequest},
+	}
+	for _, endpoint := range endpoints {
+		for _, tt := range tests {
+			w := httptest.NewRecorder()
+			endpoint(w, httptest.NewRequest("GET", tt.url, nil))
+			if tt.code == http.StatusBadRequest && w.Code != tt.code {
+				t.Errorf("GET %v code = %v; want %v", tt.url, w.Code, tt.code)
+			}
+			if tt.code != http.StatusBadRequest && w.Code == http.StatusBadRequest {
+				t.Errorf("GET %v code = %v; want not %v", tt.url, w.Code, http.StatusBadRequest)
+			}
+		}
+	}
+}
+
+func TestRegistryWarmUpErrors(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	corrupt := filepath.Join(r.config.StorageDir, "corrupt")
+	if err := os.Mkdir(corrupt, 0755); err != nil {
+		t.Fatalf("os.Mkdir(%v) failed: %v", corrupt, err)
+	}
+
+	tests := []struct {
+		names []string
+		kind  error
+	}{
+		{[]string{}, nil},
+		{[]string{"missing"}, nil},
+		{[]string{"corrupt", "missing"}, storage.ErrCorruptRepo},
+	}
+	for _, tt := range tests {
+		if err := r.warmUp(tt.names); storage.Kind(err) != tt.kind {
+			t.Errorf("r.warmUp(%v) = %v; want error of kind %v", tt.names, err, tt.kind)
+		}
+	}
+
+	r.shasums.Close()
+	if err := r.warmUp([]string{"missing"}); err != errShasumPoolClosed {
+		t.Errorf("r.warmUp() after Close = %v; want %v", err, errShasumPoolClosed)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexanderGugel/nerva/storage"
+	"reflect"
+)
+
+// getConfig returns the currently active configuration.
+func (r *Registry) getConfig() *Config {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	return r.config
+}
+
+// getUpstreams returns the currently active upstream registries.
+func (r *Registry) getUpstreams() Upstreams {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	return r.upstreams
+}
+
+// getShaCache returns the currently active SHA cache.
+func (r *Registry) getShaCache() *storage.ShaCache {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	return r.shaCache
+}
+
+// getPkgRootCache returns the currently active package root cache, or nil if
+// it is disabled.
+func (r *Registry) getPkgRootCache() *PkgRootCache {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	return r.rootCache
+}
+
+// getPolicy returns the current policy for upstream packages, or nil if all
+// packages are allowed.
+func (r *Registry) getPolicy() *Policy {
+	r.state.RLock()
+	policyFile := r.policy
+	r.state.RUnlock()
+	if policyFile == nil {
+		return nil
+	}
+	return policyFile.Policy()
+}
+
+// Reload applies the supplied configuration to the running registry. The
+// upstream registry, cache sizes and other settings that don't require
+// rebinding the listener or reopening the storage are swapped in atomically.
+// Any other change causes the whole configuration to be rejected.
+func (r *Registry) Reload(config *Config) error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	current := r.getConfig()
+	if err := current.CheckReload(config); err != nil {
+		return err
+	}
+
+	shaCache := r.getShaCache()
+	if config.ShaCacheSize != current.ShaCacheSize {
+		var err error
+		if shaCache, err = storage.NewShaCache(config.ShaCacheSize); err != nil {
+			return err
+		}
+	}
+
+	rootCache := r.getPkgRootCache()
+	if config.PkgRootCacheSize != current.PkgRootCacheSize ||
+		config.PkgRootCacheDir != current.PkgRootCacheDir {
+		var err error
+		if rootCache, err = newPkgRootCache(config); err != nil {
+			return err
+		}
+	}
+
+	r.state.RLock()
+	policy := r.policy
+	r.state.RUnlock()
+	if config.PolicyFile != current.PolicyFile {
+		var err error
+		if policy, err = newPolicyFile(config); err != nil {
+			return err
+		}
+	}
+
+	// Upstreams are created last, since their health checks would have to be
+	// stopped if any of the previous steps failed.
+	previous := r.getUpstreams()
+	upstreams := previous
+	changed := upstreamsChanged(current, config)
+	if changed {
+		var err error
+		if upstreams, err = newUpstreams(config); err != nil {
+			return err
+		}
+	}
+
+	r.state.Lock()
+	r.config = config
+	r.upstreams = upstreams
+	r.shaCache = shaCache
+	r.rootCache = rootCache
+	r.policy = policy
+	r.state.Unlock()
+	if changed {
+		previous.Close()
+	}
+
+	config.Logger.WithFields(log.Fields{
+		"config": *config,
+	}).Info("reloaded registry")
+	return nil
+}
+
+// upstreamsChanged checks if the upstream registries need to be recreated when
+// switching from the current to the next configuration.
+func upstreamsChanged(current, next *Config) bool {
+	return !reflect.DeepEqual(current.upstreamConfigs(), next.upstreamConfigs()) ||
+		current.UpstreamCacheDir != next.UpstreamCacheDir ||
+		current.UpstreamCacheTTL != next.UpstreamCacheTTL ||
+		current.UpstreamStaleWhileRevalidate != next.UpstreamStaleWhileRevalidate
+}
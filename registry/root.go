@@ -24,7 +24,6 @@ import (
 	"github.com/alexanderGugel/nerva/storage"
 	"github.com/alexanderGugel/nerva/util"
 	"net/http"
-	"path"
 )
 
 // Root maps package names to package root descriptors. In this context,
@@ -47,11 +46,11 @@ type Root map[string]string
 // NewRoot creates a new CommonJS registry root document from a given
 // storage directory by reading in the repositories that are available in the
 // storage dir.
-func NewRoot(storage *storage.Storage, url string) (*Root, error) {
+func NewRoot(storage *storage.Storage, base *BaseURL) (*Root, error) {
 	root := Root{}
 	names, _ := storage.Ls()
 	for _, name := range names {
-		root[name] = path.Join(url, name)
+		root[name] = base.PkgRoot(name)
 	}
 	return &root, nil
 }
@@ -71,7 +70,7 @@ func NewRoot(storage *storage.Storage, url string) (*Root, error) {
 // “package root url” response.
 // See http://wiki.commonjs.org/wiki/Packages/Registry#registry_root_url
 func (r *Registry) HandleRoot(w http.ResponseWriter, req *http.Request) error {
-	res, err := NewRoot(r.storage, r.config.FrontAddr)
+	res, err := NewRoot(r.storage, r.getConfig().baseURL(req))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,240 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"github.com/alexanderGugel/nerva/storage"
+	"github.com/libgit2/git2go"
+	"io"
+	"sync"
+)
+
+// errShasumPoolClosed is returned for shasums that weren't computed because
+// the pool has been closed.
+var errShasumPoolClosed = errors.New("shasum pool closed")
+
+// ShasumFunc computes the shasum of the tarball of a package version.
+type ShasumFunc func(name string, id git.Oid) (string, error)
+
+// ShasumPool computes the shasums of package tarballs on a bounded number of
+// worker goroutines. Concurrent requests for the same object id share a single
+// computation. Jobs requested via Get take precedence over jobs queued via
+// Prefetch, e.g. by the warm-up after startup.
+type ShasumPool struct {
+	compute    ShasumFunc
+	urgent     chan *ShasumJob
+	background chan *ShasumJob
+	stop       chan struct{}
+	closeOnce  sync.Once
+	wg         sync.WaitGroup
+
+	mu       sync.Mutex
+	inflight map[git.Oid]*ShasumJob
+}
+
+// ShasumJob is a pending or completed shasum computation.
+type ShasumJob struct {
+	name    string
+	id      git.Oid
+	started bool // guarded by ShasumPool.mu
+	done    chan struct{}
+	shasum  string
+	err     error
+	stop    <-chan struct{}
+}
+
+// NewShasumPool starts a pool of the supplied number of workers.
+func NewShasumPool(workers int, compute ShasumFunc) *ShasumPool {
+	p := &ShasumPool{
+		compute:    compute,
+		urgent:     make(chan *ShasumJob, workers),
+		background: make(chan *ShasumJob, workers),
+		stop:       make(chan struct{}),
+		inflight:   map[git.Oid]*ShasumJob{},
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Get returns the job computing the shasum of the given object id and moves
+// it to the front of the queue if it hasn't been started yet.
+func (p *ShasumPool) Get(name string, id git.Oid) *ShasumJob {
+	job, started := p.job(name, id)
+	if !started {
+		select {
+		case p.urgent <- job:
+		case <-p.stop:
+		}
+	}
+	return job
+}
+
+// Prefetch queues the computation of the shasum of the given object id. It
+// blocks while the queue is full.
+func (p *ShasumPool) Prefetch(name string, id git.Oid) {
+	job, created := p.newJob(name, id)
+	if !created {
+		return
+	}
+	select {
+	case p.background <- job:
+	case <-p.stop:
+	}
+}
+
+// Close stops the workers. Jobs that haven't been completed yet fail.
+func (p *ShasumPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+	})
+}
+
+// closed checks if the pool has been closed.
+func (p *ShasumPool) closed() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// job returns the in-flight job for the given object id, or creates a new one.
+func (p *ShasumPool) job(name string, id git.Oid) (*ShasumJob, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job, ok := p.inflight[id]; ok {
+		return job, job.started
+	}
+	job := p.add(name, id)
+	return job, false
+}
+
+// newJob creates a new job for the given object id, unless there already is
+// one.
+func (p *ShasumPool) newJob(name string, id git.Oid) (*ShasumJob, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job, ok := p.inflight[id]; ok {
+		return job, false
+	}
+	return p.add(name, id), true
+}
+
+// add registers a new in-flight job. p.mu has to be held.
+func (p *ShasumPool) add(name string, id git.Oid) *ShasumJob {
+	job := &ShasumJob{
+		name: name,
+		id:   id,
+		done: make(chan struct{}),
+		stop: p.stop,
+	}
+	p.inflight[id] = job
+	return job
+}
+
+// work processes jobs until the pool is closed.
+func (p *ShasumPool) work() {
+	defer p.wg.Done()
+	for {
+		var job *ShasumJob
+		select {
+		case job = <-p.urgent:
+		default:
+			select {
+			case job = <-p.urgent:
+			case job = <-p.background:
+			case <-p.stop:
+				return
+			}
+		}
+		if p.closed() {
+			return
+		}
+		if !p.start(job) {
+			continue
+		}
+		shasum, err := p.compute(job.name, job.id)
+		p.mu.Lock()
+		delete(p.inflight, job.id)
+		p.mu.Unlock()
+		job.shasum, job.err = shasum, err
+		close(job.done)
+	}
+}
+
+// start marks a job as started. It returns false if another worker already
+// started it, which happens if a queued job has been requested via Get.
+func (p *ShasumPool) start(job *ShasumJob) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job.started {
+		return false
+	}
+	job.started = true
+	return true
+}
+
+// Wait blocks until the shasum has been computed.
+func (j *ShasumJob) Wait() (string, error) {
+	select {
+	case <-j.done:
+		return j.shasum, j.err
+	case <-j.stop:
+		// The job might have been completed while the pool was closed.
+		select {
+		case <-j.done:
+			return j.shasum, j.err
+		default:
+			return "", errShasumPoolClosed
+		}
+	}
+}
+
+// computeShasum computes the shasum and size of the tarball of the given
+// object.
+func computeShasum(repo *git.Repository, id *git.Oid) (string, int64, error) {
+	d, err := storage.NewDownload(repo, id)
+	if err != nil {
+		return "", 0, err
+	}
+	hasher := sha1.New()
+	var counter byteCounter
+	if err := d.Start(io.MultiWriter(hasher, &counter)); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), int64(counter), nil
+}
+
+// byteCounter is a writer that counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
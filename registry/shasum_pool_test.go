@@ -0,0 +1,137 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"github.com/libgit2/git2go"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func createOid(b byte) git.Oid {
+	var id git.Oid
+	id[0] = b
+	return id
+}
+
+func TestShasumPoolShared(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	pool := NewShasumPool(2, func(name string, id git.Oid) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "shasum-" + name, nil
+	})
+	defer pool.Close()
+
+	id := createOid(1)
+	jobs := []*ShasumJob{}
+	for i := 0; i < 10; i++ {
+		jobs = append(jobs, pool.Get("tape", id))
+	}
+	close(release)
+	for _, job := range jobs {
+		if shasum, err := job.Wait(); err != nil || shasum != "shasum-tape" {
+			t.Errorf("job.Wait() = %v, %v; want %v, nil", shasum, err, "shasum-tape")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("compute called %v times; want 1", calls)
+	}
+}
+
+func TestShasumPoolConcurrency(t *testing.T) {
+	var running, max int32
+	var mu sync.Mutex
+	pool := NewShasumPool(2, func(name string, id git.Oid) (string, error) {
+		n := atomic.AddInt32(&running, 1)
+		mu.Lock()
+		if n > max {
+			max = n
+		}
+		mu.Unlock()
+		defer atomic.AddInt32(&running, -1)
+		return "", nil
+	})
+	defer pool.Close()
+
+	jobs := []*ShasumJob{}
+	for i := 0; i < 20; i++ {
+		jobs = append(jobs, pool.Get("tape", createOid(byte(i))))
+	}
+	for _, job := range jobs {
+		job.Wait()
+	}
+	if max > 2 {
+		t.Errorf("max concurrent computations = %v; want at most 2", max)
+	}
+}
+
+func TestShasumPoolPriority(t *testing.T) {
+	started := make(chan git.Oid, 10)
+	release := make(chan struct{})
+	pool := NewShasumPool(1, func(name string, id git.Oid) (string, error) {
+		started <- id
+		<-release
+		return "", nil
+	})
+	defer pool.Close()
+
+	// Occupies the only worker.
+	first := pool.Get("tape", createOid(0))
+	<-started
+	// Fills the background queue.
+	pool.Prefetch("tape", createOid(1))
+	job := pool.Get("tape", createOid(2))
+	close(release)
+
+	first.Wait()
+	job.Wait()
+	if id := <-started; id != createOid(2) {
+		t.Errorf("first job after the running one = %v; want %v", id, createOid(2))
+	}
+}
+
+func TestShasumPoolClose(t *testing.T) {
+	release := make(chan struct{})
+	pool := NewShasumPool(1, func(name string, id git.Oid) (string, error) {
+		<-release
+		return "shasum", nil
+	})
+	running := pool.Get("tape", createOid(0))
+	queued := pool.Get("tape", createOid(1))
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	<-pool.stop
+	close(release)
+	<-closed
+
+	if shasum, err := running.Wait(); err != nil || shasum != "shasum" {
+		t.Errorf("running.Wait() = %v, %v; want %v, nil", shasum, err, "shasum")
+	}
+	if _, err := queued.Wait(); err != errShasumPoolClosed {
+		t.Errorf("queued.Wait() error = %v; want %v", err, errShasumPoolClosed)
+	}
+}
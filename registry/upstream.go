@@ -21,88 +21,363 @@
 package registry
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	log "github.com/Sirupsen/logrus"
 	"github.com/alexanderGugel/nerva/util"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"time"
 )
 
+// forwardedHeaders are the request headers that are passed through to upstream
+// registries. The client's Authorization header is only passed on to
+// upstreams with ForwardAuth.
+var forwardedHeaders = []string{
+	"Accept",
+	"If-Modified-Since",
+	"If-None-Match",
+	"Npm-Command",
+	"Npm-In-Ci",
+	"Npm-Scope",
+	"Npm-Session",
+	"Referer",
+	"User-Agent",
+	util.RequestIDHeader,
+}
+
+// hopHeaders are hop-by-hop headers. They only apply to a single connection
+// and must not be passed on by proxies.
+// See https://golang.org/src/net/http/httputil/reverseproxy.go
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
 // Upstream represents an external registry. It provides a caching layer for
 // frequently requested packages.
 type Upstream struct {
 	URL    *url.URL
+	Match  []string
+	Mode   string
 	Client *http.Client
+
+	// Transport is used for talking to the upstream registry directly,
+	// bypassing any caches. It authenticates requests if the upstream
+	// requires credentials, and fails fast while the upstream is down.
+	Transport http.RoundTripper
+
+	Retries      int
+	RetryBackoff time.Duration
+
+	// ForwardAuth passes the client's Authorization header on to the
+	// upstream registry.
+	ForwardAuth bool
+
+	// authenticated is set if requests are authorized with nerva's own
+	// credentials rather than the client's.
+	authenticated bool
+
+	// direct bypasses the circuit breaker for health checks.
+	direct  http.RoundTripper
+	monitor *upstreamMonitor
+	stop    chan struct{}
 }
 
-// NewUpstream instantiates a new registry proxy.
+// NewUpstream instantiates a new registry proxy for all packages.
 func NewUpstream(rootURL string) (*Upstream, error) {
-	urlURL, err := url.Parse(rootURL)
+	return NewUpstreamFromConfig(&UpstreamConfig{URL: rootURL})
+}
+
+// NewUpstreamFromConfig instantiates a new registry proxy from the supplied
+// upstream configuration. If health checks are enabled, the upstream needs to
+// be closed.
+func NewUpstreamFromConfig(config *UpstreamConfig) (*Upstream, error) {
+	urlURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := config.Auth.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	authorization, err := config.Auth.authorization()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Upstream{
-		URL:    urlURL,
-		Client: &http.Client{},
-	}, nil
+	var direct http.RoundTripper = newUpstreamTransport(config.ConnectTimeout,
+		config.ReadTimeout, tlsConfig)
+	if authorization != "" {
+		direct = &authTransport{direct, urlURL.Host, authorization}
+	}
+	monitor := newUpstreamMonitor(config.FailureThreshold, config.BreakerCooldown)
+	transport := &monitoringTransport{direct, monitor}
+	upstream := &Upstream{
+		URL:           urlURL,
+		Match:         config.Match,
+		Mode:          config.Mode,
+		Client:        &http.Client{Transport: &verifyingTransport{transport}},
+		Transport:     transport,
+		Retries:       config.Retries,
+		RetryBackoff:  config.RetryBackoff,
+		ForwardAuth:   config.ForwardAuth,
+		direct:        direct,
+		monitor:       monitor,
+		authenticated: authorization != "",
+	}
+	upstream.startHealthCheck(config.HealthInterval)
+	return upstream, nil
+}
+
+// newUpstreamTransport creates a transport with the supplied timeouts. A zero
+// timeout means no timeout.
+func newUpstreamTransport(connectTimeout, readTimeout time.Duration,
+	tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := dialer.Dial(network, addr)
+			if err != nil || readTimeout == 0 {
+				return conn, err
+			}
+			return &deadlineConn{conn, readTimeout}, nil
+		},
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: readTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// deadlineConn fails reads that block for longer than the read timeout, e.g.
+// because the upstream registry stalls while sending a tarball.
+type deadlineConn struct {
+	net.Conn
+	readTimeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// Matches checks if packages with the given name should be requested from the
+// upstream registry. Match rules are glob patterns as supported by path.Match,
+// e.g. "@partner/*". An upstream without any rules matches all packages.
+func (u *Upstream) Matches(name string) bool {
+	return len(u.Match) == 0 || matchName(u.Match, name)
 }
 
 // Ping checks it the upstream registry can be reached.
 func (u *Upstream) Ping() error {
-	res, err := http.Get(u.URL.String())
+	return u.PingTimeout(0)
+}
+
+// PingTimeout checks if the upstream registry can be reached within the
+// supplied timeout. Server errors count as failures, like they do for the
+// circuit breaker.
+func (u *Upstream) PingTimeout(timeout time.Duration) error {
+	client := &http.Client{
+		Transport: u.direct,
+		Timeout:   timeout,
+	}
+	res, err := client.Get(u.URL.String())
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		return errors.New(res.Status)
+	}
 	return nil
 }
 
 // HandleReq redirects the client to the package root of the package
 // with the specified name.
 func (u *Upstream) HandleReq(w http.ResponseWriter, req *http.Request) error {
+	res, err := u.Fetch(req)
+	if err != nil {
+		return err
+	}
+	return writeUpstreamRes(w, res)
+}
+
+// Redirect redirects the client to the upstream registry. Since clients
+// re-send the body of 307 redirects, it is used for all methods except GET and
+// HEAD.
+func (u *Upstream) Redirect(w http.ResponseWriter, req *http.Request) {
+	code := http.StatusTemporaryRedirect
+	if isIdempotent(req) {
+		code = http.StatusFound
+	}
+	http.Redirect(w, req, u.resolve(req).String(), code)
+}
 
+// resolve returns the URL of the requested resource on the upstream registry.
+// The request path is relative to the upstream's URL, unless it has been
+// marked as a path on the upstream's host via withHostPath.
+func (u *Upstream) resolve(req *http.Request) *url.URL {
 	url := *u.URL
-	url.Path = path.Join(url.Path, req.URL.Path)
+	if isHostPath(req.Context()) {
+		url.Path = path.Clean("/" + req.URL.Path)
+	} else {
+		url.Path = path.Join(url.Path, req.URL.Path)
+	}
+	return &url
+}
 
-	req, err := http.NewRequest(req.Method, url.String(), req.Body)
-	if err != nil {
-		return err
+// hostPathKey is the context key marking request paths that are relative to
+// the host of the upstream registry.
+type hostPathKey struct{}
+
+// withHostPath returns a copy of ctx that determines whether request paths
+// are resolved against the host of the upstream registry rather than its URL.
+func withHostPath(ctx context.Context, hostPath bool) context.Context {
+	return context.WithValue(ctx, hostPathKey{}, hostPath)
+}
+
+// isHostPath checks if request paths are relative to the upstream's host.
+func isHostPath(ctx context.Context) bool {
+	hostPath, _ := ctx.Value(hostPathKey{}).(bool)
+	return hostPath
+}
+
+// Fetch forwards the supplied request to the upstream registry. Idempotent
+// requests are retried with exponential backoff if the upstream registry can't
+// be reached or is temporarily unavailable.
+func (u *Upstream) Fetch(req *http.Request) (*http.Response, error) {
+	url := u.resolve(req)
+
+	retries := 0
+	if isIdempotent(req) {
+		retries = u.Retries
+	}
+	backoff := u.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		upstreamReq, err := http.NewRequest(req.Method, url.String(), req.Body)
+		if err != nil {
+			return nil, err
+		}
+		upstreamReq = upstreamReq.WithContext(req.Context())
+		for _, key := range forwardedHeaders {
+			if value := req.Header.Get(key); value != "" {
+				upstreamReq.Header.Set(key, value)
+			}
+		}
+		if auth := req.Header.Get("Authorization"); auth != "" && u.ForwardAuth {
+			upstreamReq.Header.Set("Authorization", auth)
+		}
+
+		res, err := u.Client.Do(upstreamReq)
+		if attempt >= retries || !shouldRetry(res, err) {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
 	}
+}
+
+// isIdempotent checks if the supplied request can safely be retried.
+func isIdempotent(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
 
-	res, err := u.Client.Do(req)
+// shouldRetry checks if a failed request might succeed when being retried.
+func shouldRetry(res *http.Response, err error) bool {
 	if err != nil {
-		return err
+		_, isIntegrityErr := asIntegrityError(err)
+		return !isCircuitOpen(err) && !isIntegrityErr
 	}
-	copyHeader(w.Header(), res.Header)
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// writeUpstreamRes copies the response of an upstream registry, including its
+// status code.
+func writeUpstreamRes(w http.ResponseWriter, res *http.Response) error {
 	defer res.Body.Close()
+	copyResHeader(w.Header(), res.Header)
+	w.WriteHeader(res.StatusCode)
 
-	_, err = io.Copy(w, res.Body)
+	_, err := io.Copy(w, res.Body)
 	return err
 }
 
+// copyResHeader copies the header of an upstream response, except for
+// hop-by-hop headers.
+func copyResHeader(dst, src http.Header) {
+	copyHeader(dst, src)
+	for _, field := range strings.Split(src.Get("Connection"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			dst.Del(field)
+		}
+	}
+	for _, key := range hopHeaders {
+		dst.Del(key)
+	}
+}
+
 // UpstreamStatus represents the response to a request to the /upstreams
 // endpoint.
 type UpstreamStatus struct {
 	URL    string
+	Match  []string
+	Mode   string
 	Status string
+
+	Breaker     string
+	Latency     *UpstreamLatency
+	ErrorRate   float64
+	LastFailure *UpstreamFailure
 }
 
-// GetStatus returns the current status of the upstream registry.
+// GetStatus returns the current status of the upstream registry, based on the
+// most recent health check and requests. The upstream is only pinged if it
+// hasn't been health checked before.
 func (u *Upstream) GetStatus() *UpstreamStatus {
-	pingErr := u.Ping()
-	var status string
-	switch pingErr {
-	case nil:
-		status = "up"
-	default:
-		status = "down"
+	if !u.monitor.wasChecked() {
+		u.check(0)
 	}
-
-	return &UpstreamStatus{
-		URL:    u.URL.String(),
-		Status: status,
+	status := &UpstreamStatus{
+		URL:   u.URL.String(),
+		Match: u.Match,
+		Mode:  u.Mode,
 	}
+	u.monitor.fill(status)
+	return status
 }
 
 // copyHeader copies header pairs from one header to another.
@@ -115,7 +390,259 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-// HandleUpstreams retrieves the current memory stats.
+// HandleUpstream forwards the request to the upstream registries. Requests
+// for reserved packages, or if no upstream registry has been configured, are
+// answered with a 404.
+func (r *Registry) HandleUpstream(w http.ResponseWriter, req *http.Request) error {
+	config := r.getConfig()
+	name := getPkgName(req)
+	if config.isReserved(name) {
+		util.ContextLog(req, config.Logger).WithFields(log.Fields{
+			"package": name,
+		}).Warn("refused upstream request for reserved package")
+		return respondPkgNotFound(w)
+	}
+	upstreams := r.getUpstreams()
+	if len(upstreams) == 0 {
+		return respondPkgNotFound(w)
+	}
+
+	markUpstream(req)
+	policy := r.getPolicy()
+	var filter PkgRootFilter
+	if policy != nil {
+		filter = r.filterPkgRoot(policy)
+	}
+	if policy != nil && !isTarballPath(req.URL.Path) && policy.needsLicense(name) {
+		// Abbreviated package root documents don't contain licenses.
+		req = acceptFullPkgRoot(req)
+	}
+	if policy != nil && isTarballPath(req.URL.Path) {
+		version := getTarballVersion(name, path.Base(req.URL.Path))
+		rule, err := checkTarballPolicy(req, upstreams, policy, name, version)
+		if err != nil {
+			return err
+		}
+		if rule != nil {
+			r.auditor.Record(req, "blocked upstream tarball", log.Fields{
+				"package": name,
+				"version": version,
+				"reason":  rule.Reason,
+			})
+			return respondBlocked(w)
+		}
+	}
+	if config.VerifyUpstreamIntegrity && isTarballPath(req.URL.Path) {
+		verified, err := expectTarballDigest(req, upstreams, name)
+		if err != nil && !config.AllowUnverifiedUpstreamTarballs {
+			r.auditor.Record(req, "upstream tarball digest unknown", log.Fields{
+				"package": name,
+				"file":    path.Base(req.URL.Path),
+				"error":   err.Error(),
+			})
+			code := http.StatusBadGateway
+			res := &util.ErrorResponse{
+				http.StatusText(code),
+				"upstream tarball digest unknown",
+			}
+			return util.RespondJSON(w, code, res)
+		}
+		if err != nil {
+			util.LogWarn(util.ContextLog(req, config.Logger).WithFields(log.Fields{
+				"package": name,
+			}), err, "tarball digest unknown, skipping verification")
+		} else {
+			req = verified
+		}
+	}
+
+	sw := &util.StatusWriter{ResponseWriter: w}
+	err := upstreams.HandleReq(sw, req, config.baseURL(req), filter)
+	if integrityErr, ok := asIntegrityError(err); ok {
+		r.auditor.Record(req, "upstream tarball integrity mismatch", log.Fields{
+			"package":   name,
+			"file":      path.Base(req.URL.Path),
+			"algorithm": integrityErr.Algorithm,
+			"expected":  integrityErr.Expected,
+			"actual":    integrityErr.Actual,
+		})
+		if sw.Code == 0 {
+			// The tarball has been verified before anything was sent, e.g.
+			// because its body has been read while being fetched.
+			code := http.StatusBadGateway
+			res := &util.ErrorResponse{
+				http.StatusText(code),
+				"upstream tarball integrity mismatch",
+			}
+			return util.RespondJSON(w, code, res)
+		}
+		// Parts of the tarball have been sent already, so the client must
+		// notice that the response is incomplete.
+		panic(http.ErrAbortHandler)
+	}
+	return err
+}
+
+// errDigestUnknown is returned by expectTarballDigest if the package root
+// doesn't contain a digest of the requested tarball.
+var errDigestUnknown = errors.New("tarball not found in package root")
+
+// expectTarballDigest looks up the expected digest of the requested tarball
+// in the upstream package root and returns a copy of the request carrying it,
+// so that the tarball is verified when being downloaded.
+func expectTarballDigest(req *http.Request, upstreams Upstreams,
+	name string) (*http.Request, error) {
+	doc, err := upstreams.FetchPkgRoot(req, name)
+	if err != nil {
+		return nil, err
+	}
+	d := getTarballDigest(doc, path.Base(req.URL.Path))
+	if d == nil {
+		return nil, errDigestUnknown
+	}
+	return req.WithContext(withDigest(req.Context(), d)), nil
+}
+
+// checkTarballPolicy returns the rule denying the download of a tarball, or
+// nil if it is allowed. The license of the package version is looked up
+// upstream if the policy depends on it. Tarballs whose version can't be
+// determined are denied if the policy depends on the version.
+func checkTarballPolicy(req *http.Request, upstreams Upstreams, policy *Policy,
+	name string, version string) (*PolicyRule, error) {
+	if version == "" && policy.needsVersion(name) {
+		return &PolicyRule{Action: PolicyDeny, Reason: "unknown version"}, nil
+	}
+	license := ""
+	if policy.needsLicense(name) {
+		doc, err := upstreams.FetchPkgRoot(acceptFullPkgRoot(req), name)
+		if err != nil {
+			return nil, err
+		}
+		versions, _ := doc["versions"].(map[string]interface{})
+		versionDoc, _ := versions[version].(map[string]interface{})
+		license = getLicense(versionDoc)
+	}
+	return policy.Check(name, version, license), nil
+}
+
+// acceptFullPkgRoot returns a copy of req requesting the full package root
+// document rather than the abbreviated one npm asks for, which lacks licenses
+// among other things.
+func acceptFullPkgRoot(req *http.Request) *http.Request {
+	req = cloneReq(req)
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+// filterPkgRoot returns a filter removing all versions denied by policy from
+// package root documents. Packages without any allowed versions are refused.
+func (r *Registry) filterPkgRoot(policy *Policy) PkgRootFilter {
+	return func(req *http.Request, name string, doc map[string]interface{}) bool {
+		denied := policy.FilterPkgRoot(doc, name)
+		if len(denied) == 0 {
+			return true
+		}
+		reasons := map[string]string{}
+		for version, rule := range denied {
+			reasons[version] = rule.Reason
+		}
+		r.auditor.Record(req, "blocked upstream versions", log.Fields{
+			"package":  name,
+			"versions": reasons,
+		})
+		versions, _ := doc["versions"].(map[string]interface{})
+		return len(versions) > 0
+	}
+}
+
+// getTarballVersion extracts the version from the file name of a tarball,
+// e.g. "1.0.0" from "tape-1.0.0.tgz". It is empty if the file name doesn't
+// follow npm's naming scheme.
+func getTarballVersion(name, file string) string {
+	prefix := path.Base(name) + "-"
+	if !strings.HasPrefix(file, prefix) || !isTarballPath(file) {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(file, prefix), ".tgz")
+}
+
+// isPkgTarballPath checks if urlPath ends in "/<name>/-/<file>", where file
+// is the name of a tarball of the package name, e.g.
+// "/api/npm/@scope/tape/-/tape-1.0.0.tgz" for "@scope/tape".
+func isPkgTarballPath(urlPath, name string) bool {
+	dir := "/" + name + "/-/"
+	i := strings.LastIndex(urlPath, dir)
+	if i < 0 {
+		return false
+	}
+	// An unscoped name mustn't match the tarballs of a scoped package.
+	if strings.HasPrefix(path.Base(urlPath[:i]), "@") {
+		return false
+	}
+	file := urlPath[i+len(dir):]
+	return !strings.Contains(file, "/") && getTarballVersion(name, file) != ""
+}
+
+// respondPkgNotFound responds with npm's 404 for unknown packages.
+func respondPkgNotFound(w http.ResponseWriter) error {
+	code := http.StatusNotFound
+	res := &util.ErrorResponse{
+		http.StatusText(code),
+		"package not found",
+	}
+	return util.RespondJSON(w, code, res)
+}
+
+// respondBlocked refuses a package that has been blocked by the policy.
+func respondBlocked(w http.ResponseWriter) error {
+	code := http.StatusForbidden
+	res := &util.ErrorResponse{
+		http.StatusText(code),
+		"blocked by policy",
+	}
+	return util.RespondJSON(w, code, res)
+}
+
+// HandleUpstreamDownload handles downloads of tarballs at "/name/-/file",
+// which is where package root documents of upstream registries used to point
+// to before their tarball URLs kept the upstream path.
+func (r *Registry) HandleUpstreamDownload(w http.ResponseWriter, req *http.Request) error {
+	return r.HandleUpstream(w, req)
+}
+
+// HandleUpstreamTarball handles downloads of tarballs that have been
+// referenced by rewritten package root documents of upstream registries. The
+// path following "/-/upstream/name/-/" is the path of the tarball on the host
+// of the upstream registry. It has to be the path of one of the package's
+// tarballs, since reserved names and the policy are only checked for name.
+func (r *Registry) HandleUpstreamTarball(w http.ResponseWriter, req *http.Request) error {
+	name := getPkgName(req)
+	prefix := "/-/upstream/" + name + "/-/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		return respondPkgNotFound(w)
+	}
+	tarballPath := path.Clean("/" + strings.TrimPrefix(req.URL.Path, prefix))
+	if !isPkgTarballPath(tarballPath, name) {
+		return respondPkgNotFound(w)
+	}
+	tarballURL := *req.URL
+	tarballURL.Path = tarballPath
+	tarballURL.RawPath = ""
+	req = req.WithContext(withHostPath(req.Context(), true))
+	req.URL = &tarballURL
+	return r.HandleUpstream(w, req)
+}
+
+// HandleUpstreams retrieves the current status of all upstream registries.
 func (r *Registry) HandleUpstreams(w http.ResponseWriter, req *http.Request) error {
-	return util.RespondJSON(w, 200, r.upstream.GetStatus())
+	upstreams := r.getUpstreams()
+	if len(upstreams) == 0 {
+		code := http.StatusNotFound
+		res := &util.ErrorResponse{
+			http.StatusText(code),
+			"no upstream configured",
+		}
+		return util.RespondJSON(w, code, res)
+	}
+	return util.RespondJSON(w, 200, upstreams.GetStatus())
 }
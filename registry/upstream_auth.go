@@ -0,0 +1,172 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// UpstreamAuthConfig represents the credentials used for authenticating
+// against an upstream registry. Secrets can either be specified directly, or
+// be read from an environment variable (*Env) or a file (*File). Secrets that
+// are specified directly are omitted when the config is logged.
+type UpstreamAuthConfig struct {
+	Token     string `json:"-"`
+	TokenEnv  string
+	TokenFile string
+
+	Username     string
+	Password     string `json:"-"`
+	PasswordEnv  string
+	PasswordFile string
+
+	// CertFile and KeyFile are a client certificate for mutual TLS. CAFile is
+	// a PEM bundle of additional certificate authorities to trust.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// isEmpty checks if no authentication has been configured.
+func (c *UpstreamAuthConfig) isEmpty() bool {
+	return *c == UpstreamAuthConfig{}
+}
+
+// hasToken checks if a bearer token has been configured.
+func (c *UpstreamAuthConfig) hasToken() bool {
+	return c.Token != "" || c.TokenEnv != "" || c.TokenFile != ""
+}
+
+// Validate checks if the supplied credentials are consistent. Secrets are not
+// read until the upstream is created.
+func (c *UpstreamAuthConfig) Validate() error {
+	if c.hasToken() && c.Username != "" {
+		return errors.New("upstream auth can't use both Token and Username")
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("upstream auth requires both CertFile and KeyFile")
+	}
+	return nil
+}
+
+// authorization returns the Authorization header to be sent to the upstream
+// registry. It is empty if neither a token nor basic auth have been
+// configured.
+func (c *UpstreamAuthConfig) authorization() (string, error) {
+	if c.hasToken() {
+		token, err := readSecret(c.Token, c.TokenEnv, c.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	if c.Username != "" {
+		password, err := readSecret(c.Password, c.PasswordEnv, c.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(c.Username, password)
+		return req.Header.Get("Authorization"), nil
+	}
+	return "", nil
+}
+
+// tlsConfig returns the TLS configuration for connecting to the upstream
+// registry, or nil if the defaults should be used.
+func (c *UpstreamAuthConfig) tlsConfig() (*tls.Config, error) {
+	if c.CertFile == "" && c.CAFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// readSecret returns the secret that is either specified directly, stored in
+// the environment variable env or in file.
+func readSecret(value, env, file string) (string, error) {
+	switch {
+	case value != "":
+		return value, nil
+	case env != "":
+		value = os.Getenv(env)
+		if value == "" {
+			return "", fmt.Errorf("environment variable %v is empty", env)
+		}
+		return value, nil
+	case file != "":
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(contents)), nil
+	}
+	return "", nil
+}
+
+// authTransport authenticates requests to the upstream registry. The
+// credentials replace those of the client and are only sent to host, not to
+// hosts the upstream registry redirects to.
+type authTransport struct {
+	next          http.RoundTripper
+	host          string
+	authorization string
+}
+
+// RoundTrip sets the Authorization header of requests to the upstream
+// registry.
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneReq(req)
+	if req.URL.Host == t.host {
+		req.Header.Set("Authorization", t.authorization)
+	} else {
+		req.Header.Del("Authorization")
+	}
+	return t.next.RoundTrip(req)
+}
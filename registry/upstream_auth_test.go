@@ -0,0 +1,148 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerva-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("NERVA_TEST_TOKEN", "from-env")
+	defer os.Unsetenv("NERVA_TEST_TOKEN")
+
+	tests := []struct {
+		value, env, file string
+		secret           string
+	}{
+		{"value", "NERVA_TEST_TOKEN", file, "value"},
+		{"", "NERVA_TEST_TOKEN", file, "from-env"},
+		{"", "", file, "from-file"},
+		{"", "", "", ""},
+	}
+	for _, tt := range tests {
+		secret, err := readSecret(tt.value, tt.env, tt.file)
+		if err != nil {
+			t.Errorf("readSecret(%q, %q, %q) failed: %v", tt.value, tt.env, tt.file, err)
+		}
+		if secret != tt.secret {
+			t.Errorf("readSecret(%q, %q, %q) = %q; want %q", tt.value, tt.env, tt.file, secret, tt.secret)
+		}
+	}
+
+	if _, err := readSecret("", "NERVA_TEST_MISSING", ""); err == nil {
+		t.Errorf("readSecret() with empty environment variable should fail")
+	}
+}
+
+func TestUpstreamAuth(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		auth          UpstreamAuthConfig
+		authorization string
+	}{
+		{UpstreamAuthConfig{Token: "secret"}, "Bearer secret"},
+		{UpstreamAuthConfig{Username: "nerva", Password: "secret"}, "Basic bmVydmE6c2VjcmV0"},
+	}
+	for _, tt := range tests {
+		upstream, err := NewUpstreamFromConfig(&UpstreamConfig{URL: server.URL, Auth: tt.auth})
+		if err != nil {
+			t.Fatalf("NewUpstreamFromConfig() failed: %v", err)
+		}
+
+		req := httptest.NewRequest("GET", "/tape", nil)
+		req.Header.Set("Authorization", "Bearer client")
+		res, err := upstream.Fetch(req)
+		if err != nil {
+			t.Fatalf("upstream.Fetch() failed: %v", err)
+		}
+		res.Body.Close()
+		if authorization != tt.authorization {
+			t.Errorf("Fetch() Authorization = %q; want %q", authorization, tt.authorization)
+		}
+
+		authorization = ""
+		if err := upstream.Ping(); err != nil {
+			t.Fatalf("upstream.Ping() failed: %v", err)
+		}
+		if authorization != tt.authorization {
+			t.Errorf("Ping() Authorization = %q; want %q", authorization, tt.authorization)
+		}
+	}
+}
+
+func TestUpstreamAuthValidate(t *testing.T) {
+	tests := []struct {
+		auth    UpstreamAuthConfig
+		isValid bool
+	}{
+		{UpstreamAuthConfig{}, true},
+		{UpstreamAuthConfig{TokenEnv: "NPM_TOKEN"}, true},
+		{UpstreamAuthConfig{Username: "nerva", PasswordFile: "/run/secrets/npm"}, true},
+		{UpstreamAuthConfig{Token: "secret", Username: "nerva"}, false},
+		{UpstreamAuthConfig{CertFile: "client.pem"}, false},
+		{UpstreamAuthConfig{CertFile: "client.pem", KeyFile: "client.key"}, true},
+	}
+	for _, tt := range tests {
+		err := tt.auth.Validate()
+		if isValid := err == nil; isValid != tt.isValid {
+			t.Errorf("%+v.Validate() = %v; want valid = %t", tt.auth, err, tt.isValid)
+		}
+	}
+}
+
+func TestUpstreamAuthNotLogged(t *testing.T) {
+	config := DefaultConfig()
+	config.Upstreams = []*UpstreamConfig{
+		{URL: "https://npm.partner.com", Auth: UpstreamAuthConfig{Token: "token-secret"}},
+		{URL: "https://npm.other.com", Auth: UpstreamAuthConfig{Username: "nerva", Password: "password-secret"}},
+	}
+	// The JSON log formatter marshals logged fields.
+	data, err := json.Marshal(*config)
+	if err != nil {
+		t.Fatalf("json.Marshal(config) failed: %v", err)
+	}
+	for _, secret := range []string{"token-secret", "password-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("json.Marshal(config) = %s; contains %q", data, secret)
+		}
+	}
+}
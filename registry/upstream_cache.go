@@ -0,0 +1,496 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// UpstreamCacheHeader reports whether a response has been served from the
+// upstream cache.
+const UpstreamCacheHeader = "X-Nerva-Cache"
+
+// cachedHeaders are the response headers stored alongside cached responses.
+var cachedHeaders = []string{"Content-Type", "ETag", "Last-Modified"}
+
+// UpstreamCache caches responses of upstream registries on disk. Package root
+// documents are revalidated via their ETag once they are older than TTL.
+// Tarballs are immutable and never revalidated. If an upstream registry can't
+// be reached, stale package root documents are served instead.
+//
+// Package root documents that are older than TTL, but not older than TTL plus
+// StaleWhileRevalidate, are served immediately while being revalidated in the
+// background.
+//
+// Responses are cached per URL and Accept header, since npm requests
+// abbreviated package root documents. Requests carrying the client's
+// credentials are never cached.
+type UpstreamCache struct {
+	Dir                  string
+	TTL                  time.Duration
+	StaleWhileRevalidate time.Duration
+}
+
+// upstreamCacheEntry is the metadata of a cached response.
+type upstreamCacheEntry struct {
+	URL       string      `json:"url"`
+	Accept    string      `json:"accept,omitempty"`
+	Header    http.Header `json:"header"`
+	FetchedAt time.Time   `json:"fetchedAt"`
+}
+
+// NewUpstreamCache creates a new upstream cache in the supplied directory.
+func NewUpstreamCache(dir string, ttl time.Duration) (*UpstreamCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &UpstreamCache{Dir: dir, TTL: ttl}, nil
+}
+
+// Wrap returns a transport that serves requests from the cache and populates
+// it via next.
+func (c *UpstreamCache) Wrap(next http.RoundTripper) http.RoundTripper {
+	return c.wrap(next, false)
+}
+
+// wrap returns a caching transport. If authenticated is set, next replaces
+// the client's credentials with nerva's own, so that responses to requests
+// carrying an Authorization header can be shared between clients.
+func (c *UpstreamCache) wrap(next http.RoundTripper,
+	authenticated bool) *cachingTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &cachingTransport{
+		cache:         c,
+		next:          next,
+		authenticated: authenticated,
+		refreshing:    map[string]bool{},
+	}
+}
+
+// upstreamCacheKey identifies cached responses. The Accept header is ignored
+// for tarballs, which don't have different representations.
+func upstreamCacheKey(url string, accept string) string {
+	if isTarballPath(url) {
+		return url
+	}
+	return url + "\n" + accept
+}
+
+// reqCacheKey returns the cache key for the supplied request.
+func reqCacheKey(req *http.Request) string {
+	return upstreamCacheKey(req.URL.String(), req.Header.Get("Accept"))
+}
+
+// key returns the cache key of the entry.
+func (e *upstreamCacheEntry) key() string {
+	return upstreamCacheKey(e.URL, e.Accept)
+}
+
+// paths returns the paths of the body and metadata files for the given key.
+func (c *UpstreamCache) paths(key string) (string, string) {
+	sum := sha1.Sum([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+	base := filepath.Join(c.Dir, hash[:2], hash)
+	return base, base + ".json"
+}
+
+// load opens the cached response for the given key.
+func (c *UpstreamCache) load(key string) (*upstreamCacheEntry, *os.File, error) {
+	bodyPath, metaPath := c.paths(key)
+	meta, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry := &upstreamCacheEntry{}
+	if err := json.Unmarshal(meta, entry); err != nil {
+		return nil, nil, err
+	}
+	body, err := os.Open(bodyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, body, nil
+}
+
+// saveMeta atomically writes the metadata of a cached response.
+func (c *UpstreamCache) saveMeta(entry *upstreamCacheEntry) error {
+	_, metaPath := c.paths(entry.key())
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(metaPath), ".meta")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(meta); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), metaPath)
+}
+
+// quarantine moves the cached response for the given key out of the way, so
+// that it is no longer served, but can still be inspected.
+func (c *UpstreamCache) quarantine(key string) {
+	bodyPath, metaPath := c.paths(key)
+	c.quarantineFile(metaPath)
+	c.quarantineFile(bodyPath)
+}
+
+// quarantineFile moves the file at the supplied path into the quarantine
+// directory.
+func (c *UpstreamCache) quarantineFile(file string) {
+	dir := filepath.Join(c.Dir, "quarantine")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		os.Remove(file)
+		return
+	}
+	name := fmt.Sprintf("%v.%d", filepath.Base(file), time.Now().UnixNano())
+	if err := os.Rename(file, filepath.Join(dir, name)); err != nil {
+		os.Remove(file)
+	}
+}
+
+// remove deletes the cached response for the given key.
+func (c *UpstreamCache) remove(key string) {
+	bodyPath, metaPath := c.paths(key)
+	os.Remove(metaPath)
+	os.Remove(bodyPath)
+}
+
+// store wraps the body of the supplied response, so that it is written to the
+// cache while being read. The entry is committed once the body has been read
+// completely.
+func (c *UpstreamCache) store(res *http.Response) (*http.Response, error) {
+	bodyPath, _ := c.paths(reqCacheKey(res.Request))
+	if err := os.MkdirAll(filepath.Dir(bodyPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(bodyPath), ".body")
+	if err != nil {
+		return nil, err
+	}
+	entry := &upstreamCacheEntry{
+		URL:       res.Request.URL.String(),
+		Accept:    res.Request.Header.Get("Accept"),
+		Header:    http.Header{},
+		FetchedAt: time.Now(),
+	}
+	for _, key := range cachedHeaders {
+		if value := res.Header.Get(key); value != "" {
+			entry.Header.Set(key, value)
+		}
+	}
+	res.Body = &cacheBody{
+		body:       res.Body,
+		tmp:        tmp,
+		quarantine: c.quarantineFile,
+		commit: func() error {
+			if err := os.Rename(tmp.Name(), bodyPath); err != nil {
+				return err
+			}
+			return c.saveMeta(entry)
+		},
+	}
+	res.Header.Set(UpstreamCacheHeader, "MISS")
+	return res, nil
+}
+
+// cachingTransport is a http.RoundTripper backed by an UpstreamCache.
+type cachingTransport struct {
+	cache         *UpstreamCache
+	next          http.RoundTripper
+	authenticated bool
+
+	mu         sync.Mutex
+	refreshing map[string]bool
+}
+
+// isImmutable checks if the requested resource never changes.
+func isImmutable(req *http.Request) bool {
+	return isTarballPath(req.URL.Path)
+}
+
+// RoundTrip serves GET requests from the cache if possible. Conditional
+// requests of clients are answered from the cache as well, but never forwarded,
+// since a 304 of the upstream registry can't be used for populating the cache.
+// Requests authorized by the client bypass the cache.
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet ||
+		(!t.authenticated && req.Header.Get("Authorization") != "") {
+		return t.next.RoundTrip(req)
+	}
+	key := reqCacheKey(req)
+
+	clientETag := req.Header.Get("If-None-Match")
+	req = cloneReq(req)
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	entry, body, err := t.cache.load(key)
+	if err != nil {
+		return t.fetch(req)
+	}
+	if etagMatches(clientETag, entry.Header.Get("ETag")) &&
+		(isImmutable(req) || time.Since(entry.FetchedAt) < t.cache.TTL) {
+		body.Close()
+		return newNotModifiedRes(req, entry), nil
+	}
+	age := time.Since(entry.FetchedAt)
+	if isImmutable(req) {
+		res, err := newCachedRes(req, entry, body, "HIT")
+		if err == nil {
+			if d := getDigest(req.Context()); d != nil {
+				res.Body = newVerifyingBody(res.Body, d, func() {
+					t.cache.quarantine(key)
+				})
+			}
+		}
+		return res, err
+	}
+	if age < t.cache.TTL {
+		return newCachedRes(req, entry, body, "HIT")
+	}
+	if age < t.cache.TTL+t.cache.StaleWhileRevalidate {
+		t.refresh(req, entry)
+		return newCachedRes(req, entry, body, "STALE")
+	}
+
+	// The cached package root document is stale and needs to be revalidated.
+	res, err := t.revalidate(req, entry)
+	if err != nil {
+		return newCachedRes(req, entry, body, "STALE")
+	}
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		res.Body.Close()
+		return newCachedRes(req, entry, body, "REVALIDATED")
+	case res.StatusCode >= http.StatusInternalServerError:
+		res.Body.Close()
+		return newCachedRes(req, entry, body, "STALE")
+	}
+	body.Close()
+	return t.handleRes(res)
+}
+
+// revalidate requests the resource of a cache entry from the upstream
+// registry unless it has been modified. If it hasn't, the entry is marked as
+// fresh.
+func (t *cachingTransport) revalidate(req *http.Request,
+	entry *upstreamCacheEntry) (*http.Response, error) {
+	revalidateReq := cloneReq(req)
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		revalidateReq.Header.Set("If-None-Match", etag)
+	}
+	res, err := t.next.RoundTrip(revalidateReq)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified {
+		entry.FetchedAt = time.Now()
+		t.cache.saveMeta(entry)
+	}
+	return res, nil
+}
+
+// refresh revalidates a cache entry in the background. Only one refresh per
+// entry runs at a time.
+func (t *cachingTransport) refresh(req *http.Request, entry *upstreamCacheEntry) {
+	key := entry.key()
+	t.mu.Lock()
+	if t.refreshing[key] {
+		t.mu.Unlock()
+		return
+	}
+	t.refreshing[key] = true
+	t.mu.Unlock()
+
+	req = cloneReq(req).WithContext(context.Background())
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.refreshing, key)
+			t.mu.Unlock()
+		}()
+		res, err := t.revalidate(req, entry)
+		if err != nil {
+			return
+		}
+		if res.StatusCode >= http.StatusInternalServerError ||
+			res.StatusCode == http.StatusNotModified {
+			res.Body.Close()
+			return
+		}
+		res, err = t.handleRes(res)
+		if err != nil {
+			return
+		}
+		// The response is only committed to the cache once it has been read.
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+}
+
+// fetch requests the resource from the upstream registry and caches it.
+func (t *cachingTransport) fetch(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return t.handleRes(res)
+}
+
+// handleRes caches successful responses. Packages that have been removed from
+// the upstream registry are removed from the cache as well.
+func (t *cachingTransport) handleRes(res *http.Response) (*http.Response, error) {
+	switch res.StatusCode {
+	case http.StatusOK:
+		cached, err := t.cache.store(res)
+		if err != nil {
+			// Failing to cache the response shouldn't fail the request.
+			return res, nil
+		}
+		return cached, nil
+	case http.StatusNotFound, http.StatusGone:
+		t.cache.remove(reqCacheKey(res.Request))
+	}
+	return res, nil
+}
+
+// newCachedRes creates a response from a cache entry.
+func newCachedRes(req *http.Request, entry *upstreamCacheEntry, body *os.File,
+	status string) (*http.Response, error) {
+	info, err := body.Stat()
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	header := http.Header{}
+	copyHeader(header, entry.Header)
+	header.Set(UpstreamCacheHeader, status)
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: info.Size(),
+		Request:       req,
+	}, nil
+}
+
+// newNotModifiedRes creates a 304 response for a cache entry that the client
+// already has.
+func newNotModifiedRes(req *http.Request, entry *upstreamCacheEntry) *http.Response {
+	header := http.Header{}
+	copyHeader(header, entry.Header)
+	header.Del("Content-Type")
+	header.Set(UpstreamCacheHeader, "HIT")
+	return &http.Response{
+		Status:     "304 Not Modified",
+		StatusCode: http.StatusNotModified,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// cloneReq creates a shallow copy of the supplied request with a separate
+// header.
+func cloneReq(req *http.Request) *http.Request {
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = http.Header{}
+	copyHeader(clone.Header, req.Header)
+	return clone
+}
+
+// cacheBody writes the body of a response to a temporary file while it is
+// being read. Once the body has been read completely, the file is committed
+// to the cache.
+type cacheBody struct {
+	body       io.ReadCloser
+	tmp        *os.File
+	commit     func() error
+	quarantine func(string)
+	err        error
+	done       bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 && b.err == nil {
+		_, b.err = b.tmp.Write(p[:n])
+	}
+	if _, ok := asIntegrityError(err); ok && !b.done {
+		// The body has been tampered with, so it must never be served.
+		b.done = true
+		b.tmp.Close()
+		b.quarantine(b.tmp.Name())
+	}
+	if err == io.EOF && !b.done {
+		b.done = true
+		if closeErr := b.tmp.Close(); b.err == nil {
+			b.err = closeErr
+		}
+		if b.err == nil {
+			b.err = b.commit()
+		}
+		if b.err != nil {
+			os.Remove(b.tmp.Name())
+		}
+	}
+	return n, err
+}
+
+func (b *cacheBody) Close() error {
+	if !b.done {
+		// The body hasn't been read completely, so it can't be cached.
+		b.done = true
+		b.tmp.Close()
+		os.Remove(b.tmp.Name())
+	}
+	return b.body.Close()
+}
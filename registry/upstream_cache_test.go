@@ -0,0 +1,286 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createCachedUpstream creates an upstream that is backed by a cache and a
+// test server. The test server counts the requests it received.
+func createCachedUpstream(ttl time.Duration, t *testing.T) (*Upstream, *httptest.Server, *int32, func()) {
+	dir, err := ioutil.TempDir("", "upstream_cache_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed: %v", err)
+	}
+	cache, err := NewUpstreamCache(dir, ttl)
+	if err != nil {
+		t.Fatalf("NewUpstreamCache(%v, %v) failed: %v", dir, ttl, err)
+	}
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body of " + req.URL.Path))
+	}))
+
+	upstream := createUpstream(server.URL, t)
+	upstream.Client.Transport = cache.Wrap(nil)
+	return upstream, server, &hits, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func fetchUpstream(u *Upstream, path string, t *testing.T) (string, string) {
+	return fetchUpstreamHeader(u, path, http.Header{}, t)
+}
+
+func fetchUpstreamHeader(u *Upstream, path string, header http.Header, t *testing.T) (string, string) {
+	req := httptest.NewRequest("GET", path, nil)
+	copyHeader(req.Header, header)
+	res, err := u.Fetch(req)
+	if err != nil {
+		t.Fatalf("u.Fetch(%v) failed: %v", path, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ioutil.ReadAll failed: %v", err)
+	}
+	return string(body), res.Header.Get(UpstreamCacheHeader)
+}
+
+func TestUpstreamCacheHit(t *testing.T) {
+	u, _, hits, cleanup := createCachedUpstream(time.Hour, t)
+	defer cleanup()
+
+	want := "body of /tape"
+	for i, wantStatus := range []string{"MISS", "HIT"} {
+		body, status := fetchUpstream(u, "/tape", t)
+		if body != want || status != wantStatus {
+			t.Errorf("%d: fetchUpstream() = %q, %v; want %q, %v", i, body, status, want, wantStatus)
+		}
+	}
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Errorf("hits = %v; want %v", got, 1)
+	}
+}
+
+func TestUpstreamCacheRevalidate(t *testing.T) {
+	u, _, hits, cleanup := createCachedUpstream(0, t)
+	defer cleanup()
+
+	want := "body of /tape"
+	for i, wantStatus := range []string{"MISS", "REVALIDATED"} {
+		body, status := fetchUpstream(u, "/tape", t)
+		if body != want || status != wantStatus {
+			t.Errorf("%d: fetchUpstream() = %q, %v; want %q, %v", i, body, status, want, wantStatus)
+		}
+	}
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Errorf("hits = %v; want %v", got, 2)
+	}
+}
+
+func TestUpstreamCacheStale(t *testing.T) {
+	u, server, _, cleanup := createCachedUpstream(0, t)
+	defer cleanup()
+
+	fetchUpstream(u, "/tape", t)
+	server.Close()
+
+	want := "body of /tape"
+	if body, status := fetchUpstream(u, "/tape", t); body != want || status != "STALE" {
+		t.Errorf("fetchUpstream() = %q, %v; want %q, %v", body, status, want, "STALE")
+	}
+}
+
+func TestUpstreamCacheImmutableTarball(t *testing.T) {
+	u, server, hits, cleanup := createCachedUpstream(0, t)
+	defer cleanup()
+
+	path := "/tape/-/tape-4.6.0.tgz"
+	fetchUpstream(u, path, t)
+	server.Close()
+
+	want := "body of " + path
+	if body, status := fetchUpstream(u, path, t); body != want || status != "HIT" {
+		t.Errorf("fetchUpstream() = %q, %v; want %q, %v", body, status, want, "HIT")
+	}
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Errorf("hits = %v; want %v", got, 1)
+	}
+}
+
+func TestUpstreamCachePartialRead(t *testing.T) {
+	u, _, hits, cleanup := createCachedUpstream(time.Hour, t)
+	defer cleanup()
+
+	res, err := u.Fetch(httptest.NewRequest("GET", "/tape", nil))
+	if err != nil {
+		t.Fatalf("u.Fetch() failed: %v", err)
+	}
+	res.Body.Close()
+
+	if _, status := fetchUpstream(u, "/tape", t); status != "MISS" {
+		t.Errorf("fetchUpstream() status = %v; want %v", status, "MISS")
+	}
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Errorf("hits = %v; want %v", got, 2)
+	}
+}
+
+func TestUpstreamCacheStaleWhileRevalidate(t *testing.T) {
+	u, _, hits, cleanup := createCachedUpstream(0, t)
+	defer cleanup()
+	transport := u.Client.Transport.(*cachingTransport)
+	transport.cache.StaleWhileRevalidate = time.Hour
+
+	fetchUpstream(u, "/tape", t)
+	want := "body of /tape"
+	if body, status := fetchUpstream(u, "/tape", t); body != want || status != "STALE" {
+		t.Errorf("fetchUpstream() = %q, %v; want %q, %v", body, status, want, "STALE")
+	}
+
+	// The entry is revalidated in the background.
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(hits) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Errorf("hits = %v; want %v", got, 2)
+	}
+}
+
+func TestUpstreamCacheQuarantine(t *testing.T) {
+	u, _, hits, cleanup := createCachedUpstream(time.Hour, t)
+	defer cleanup()
+	cache := u.Client.Transport.(*cachingTransport).cache
+	u.Client.Transport = cache.Wrap(&verifyingTransport{http.DefaultTransport})
+
+	d := parseIntegrity(sha512Integrity("expected body"))
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/tape/-/tape-1.0.0.tgz", nil)
+		req = req.WithContext(withDigest(req.Context(), d))
+		res, err := u.Fetch(req)
+		if err != nil {
+			t.Fatalf("u.Fetch() failed: %v", err)
+		}
+		_, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if _, ok := asIntegrityError(err); !ok {
+			t.Errorf("%d: ioutil.ReadAll() = %v; want integrity error", i, err)
+		}
+	}
+	// The tampered tarball must not have been cached.
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Errorf("hits = %v; want %v", got, 2)
+	}
+	quarantined, err := ioutil.ReadDir(filepath.Join(cache.Dir, "quarantine"))
+	if err != nil || len(quarantined) != 2 {
+		t.Errorf("quarantined files = %v, %v; want 2 files", len(quarantined), err)
+	}
+}
+
+func TestUpstreamCacheAccept(t *testing.T) {
+	u, _, hits, cleanup := createCachedUpstream(time.Hour, t)
+	defer cleanup()
+
+	corgi := http.Header{"Accept": {"application/vnd.npm.install-v1+json"}}
+	full := http.Header{"Accept": {"application/json"}}
+	tests := []struct {
+		header     http.Header
+		wantStatus string
+	}{
+		{corgi, "MISS"},
+		{full, "MISS"},
+		{corgi, "HIT"},
+		{full, "HIT"},
+	}
+	for i, tt := range tests {
+		if _, status := fetchUpstreamHeader(u, "/tape", tt.header, t); status != tt.wantStatus {
+			t.Errorf("%d: fetchUpstreamHeader(%v) status = %v; want %v", i, tt.header, status, tt.wantStatus)
+		}
+	}
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Errorf("hits = %v; want %v", got, 2)
+	}
+}
+
+func TestUpstreamCacheAuthorization(t *testing.T) {
+	u, _, hits, cleanup := createCachedUpstream(time.Hour, t)
+	defer cleanup()
+	cache := u.Client.Transport.(*cachingTransport).cache
+	u.ForwardAuth = true
+
+	header := http.Header{"Authorization": {"Bearer client"}}
+	for i := 0; i < 2; i++ {
+		if _, status := fetchUpstreamHeader(u, "/tape", header, t); status != "" {
+			t.Errorf("%d: fetchUpstreamHeader() status = %v; want none", i, status)
+		}
+	}
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Errorf("hits = %v; want %v", got, 2)
+	}
+
+	// The client's credentials are replaced by nerva's own.
+	u.Client.Transport = cache.wrap(nil, true)
+	for i, wantStatus := range []string{"MISS", "HIT"} {
+		if _, status := fetchUpstreamHeader(u, "/tape", header, t); status != wantStatus {
+			t.Errorf("%d: fetchUpstreamHeader() status = %v; want %v", i, status, wantStatus)
+		}
+	}
+}
+
+func TestUpstreamCacheWeakETag(t *testing.T) {
+	u, _, hits, cleanup := createCachedUpstream(time.Hour, t)
+	defer cleanup()
+
+	fetchUpstream(u, "/tape", t)
+	req := httptest.NewRequest("GET", "/tape", nil)
+	// Package root documents are served with a weak ETag, since their tarball
+	// URLs are rewritten.
+	req.Header.Set("If-None-Match", `W/"v1"`)
+	res, err := u.Fetch(req)
+	if err != nil {
+		t.Fatalf("u.Fetch() failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("res.StatusCode = %v; want %v", res.StatusCode, http.StatusNotModified)
+	}
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Errorf("hits = %v; want %v", got, 1)
+	}
+}
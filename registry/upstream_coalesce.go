@@ -0,0 +1,206 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"github.com/hashicorp/golang-lru"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCoalescedBodySize is the maximum size of a response body that is shared
+// between coalesced requests. Larger responses are only returned to the
+// request that fetched them; the other requests are sent separately.
+const maxCoalescedBodySize = 16 << 20
+
+// notFoundCacheSize is the maximum number of 404 responses kept in memory per
+// upstream registry.
+const notFoundCacheSize = 10000
+
+// coalescingTransport collapses identical concurrent GET requests for package
+// root documents into a single request to the upstream registry, and
+// remembers 404 responses for notFoundTTL. Tarballs are passed through, so
+// that they are streamed to the client instead of being buffered in memory.
+type coalescingTransport struct {
+	next        http.RoundTripper
+	notFoundTTL time.Duration
+	notFound    *lru.Cache
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is an in-flight request whose response is shared by all requests
+// with the same key.
+type flight struct {
+	done   chan struct{}
+	res    *bufferedRes
+	err    error
+	shared bool
+
+	// waiters is the number of requests waiting for the response. It is
+	// guarded by coalescingTransport.mu.
+	waiters int
+}
+
+// bufferedRes is a response whose body has been read into memory.
+type bufferedRes struct {
+	res     *http.Response
+	body    []byte
+	expires time.Time
+}
+
+// newCoalescingTransport creates a transport that coalesces requests sent via
+// next. If notFoundTTL is zero, 404 responses aren't cached.
+func newCoalescingTransport(next http.RoundTripper,
+	notFoundTTL time.Duration) (*coalescingTransport, error) {
+	notFound, err := lru.New(notFoundCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &coalescingTransport{
+		next:        next,
+		notFoundTTL: notFoundTTL,
+		notFound:    notFound,
+		flights:     map[string]*flight{},
+	}, nil
+}
+
+// flightKey identifies requests that are answered with the same response.
+// Conditional requests are only coalesced with identical conditional
+// requests, since they might be answered with a 304.
+func flightKey(req *http.Request) string {
+	return strings.Join([]string{
+		req.URL.String(),
+		req.Header.Get("Accept"),
+		req.Header.Get("Authorization"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Modified-Since"),
+	}, "\n")
+}
+
+// RoundTrip sends the request, unless an identical request is already in
+// flight or the resource is known not to exist.
+func (t *coalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || isTarballPath(req.URL.Path) {
+		return t.next.RoundTrip(req)
+	}
+	key := flightKey(req)
+	if cached, ok := t.notFound.Get(key); ok {
+		cached := cached.(*bufferedRes)
+		if time.Now().Before(cached.expires) {
+			res := cached.newRes(req)
+			res.Header.Set(UpstreamCacheHeader, "HIT")
+			return res, nil
+		}
+		t.notFound.Remove(key)
+	}
+
+	t.mu.Lock()
+	if f, ok := t.flights[key]; ok {
+		f.waiters++
+		t.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if f.err != nil {
+			return nil, f.err
+		}
+		if !f.shared {
+			return t.next.RoundTrip(req)
+		}
+		return f.res.newRes(req), nil
+	}
+	f := &flight{done: make(chan struct{})}
+	t.flights[key] = f
+	t.mu.Unlock()
+
+	res, err := t.fetch(req, key, f)
+
+	t.mu.Lock()
+	delete(t.flights, key)
+	t.mu.Unlock()
+	close(f.done)
+	return res, err
+}
+
+// fetch sends the request on behalf of all coalesced requests. The request is
+// detached from the client's context, so that a disconnecting client doesn't
+// fail the requests waiting for the response.
+func (t *coalescingTransport) fetch(req *http.Request, key string,
+	f *flight) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req.WithContext(context.Background()))
+	if err != nil {
+		f.err = err
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCoalescedBodySize+1))
+	if err != nil {
+		res.Body.Close()
+		f.err = err
+		return nil, err
+	}
+	if len(body) > maxCoalescedBodySize {
+		res.Body = &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), res.Body),
+			Closer: res.Body,
+		}
+		return res, nil
+	}
+	res.Body.Close()
+
+	f.res = &bufferedRes{res: res, body: body}
+	f.shared = true
+	if res.StatusCode == http.StatusNotFound && t.notFoundTTL > 0 {
+		t.notFound.Add(key, &bufferedRes{
+			res:     res,
+			body:    body,
+			expires: time.Now().Add(t.notFoundTTL),
+		})
+	}
+	return f.res.newRes(req), nil
+}
+
+// newRes creates a copy of the buffered response for the supplied request.
+func (b *bufferedRes) newRes(req *http.Request) *http.Response {
+	res := new(http.Response)
+	*res = *b.res
+	res.Header = http.Header{}
+	copyHeader(res.Header, b.res.Header)
+	res.Body = ioutil.NopCloser(bytes.NewReader(b.body))
+	res.ContentLength = int64(len(b.body))
+	res.Request = req
+	return res
+}
+
+// multiReadCloser reads from Reader and closes Closer.
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
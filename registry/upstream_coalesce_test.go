@@ -0,0 +1,231 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func createCoalescingTransport(notFoundTTL time.Duration, t *testing.T) *coalescingTransport {
+	transport, err := newCoalescingTransport(http.DefaultTransport, notFoundTTL)
+	if err != nil {
+		t.Fatalf("newCoalescingTransport() failed: %v", err)
+	}
+	return transport
+}
+
+// waitForWaiters blocks until n requests are waiting for the response of the
+// in-flight request with the given key.
+func waitForWaiters(transport *coalescingTransport, key string, n int, t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		transport.mu.Lock()
+		waiters := 0
+		if f, ok := transport.flights[key]; ok {
+			waiters = f.waiters
+		}
+		transport.mu.Unlock()
+		if waiters >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("waiters = %v; want %v", waiters, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalescingTransport(t *testing.T) {
+	var hits int32
+	received := make(chan struct{}, 10)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		received <- struct{}{}
+		<-release
+		w.Write([]byte("body of " + req.URL.Path))
+	}))
+	defer server.Close()
+	transport := createCoalescingTransport(0, t)
+
+	var wg sync.WaitGroup
+	roundTrip := func() {
+		defer wg.Done()
+		req := httptest.NewRequest("GET", server.URL+"/tape", nil)
+		req.RequestURI = ""
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Errorf("transport.RoundTrip() failed: %v", err)
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		if string(body) != "body of /tape" {
+			t.Errorf("body = %q; want %q", body, "body of /tape")
+		}
+	}
+
+	// The first request is in flight once the server received it.
+	wg.Add(1)
+	go roundTrip()
+	<-received
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go roundTrip()
+	}
+	req := httptest.NewRequest("GET", server.URL+"/tape", nil)
+	waitForWaiters(transport, flightKey(req), 9, t)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("hits = %v; want %v", got, 1)
+	}
+}
+
+func TestCoalescingTransportConditional(t *testing.T) {
+	var hits int32
+	received := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		received <- struct{}{}
+		<-release
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	}))
+	defer server.Close()
+	transport := createCoalescingTransport(0, t)
+
+	codes := make(chan int, 2)
+	roundTrip := func(etag string) {
+		req := httptest.NewRequest("GET", server.URL+"/tape", nil)
+		req.RequestURI = ""
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Errorf("transport.RoundTrip() failed: %v", err)
+			codes <- 0
+			return
+		}
+		res.Body.Close()
+		codes <- res.StatusCode
+	}
+
+	// The unconditional request must not share the 304 of the conditional one.
+	go roundTrip(`"v1"`)
+	<-received
+	go roundTrip("")
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Errorf("unconditional request has been coalesced with conditional one")
+	}
+	close(release)
+
+	got := map[int]bool{<-codes: true, <-codes: true}
+	if !got[http.StatusOK] || !got[http.StatusNotModified] {
+		t.Errorf("status codes = %v; want %v and %v", got, http.StatusOK, http.StatusNotModified)
+	}
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("hits = %v; want %v", got, 2)
+	}
+}
+
+func TestCoalescingTransportNotFound(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		notFoundTTL time.Duration
+		hits        int32
+	}{
+		{time.Hour, 1},
+		{0, 2},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&hits, 0)
+		transport := createCoalescingTransport(tt.notFoundTTL, t)
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("GET", server.URL+"/tape", nil)
+			req.RequestURI = ""
+			res, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("transport.RoundTrip() failed: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusNotFound {
+				t.Errorf("res.StatusCode = %v; want %v", res.StatusCode, http.StatusNotFound)
+			}
+		}
+		if got := atomic.LoadInt32(&hits); got != tt.hits {
+			t.Errorf("notFoundTTL = %v: hits = %v; want %v", tt.notFoundTTL, got, tt.hits)
+		}
+	}
+}
+
+func TestCoalescingTransportTarball(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("tar"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("ball"))
+	}))
+	defer server.Close()
+	defer close(release)
+	transport := createCoalescingTransport(0, t)
+
+	// Tarballs are returned before their body has been downloaded.
+	done := make(chan error, 1)
+	go func() {
+		req := httptest.NewRequest("GET", server.URL+"/tape/-/tape-1.0.0.tgz", nil)
+		req.RequestURI = ""
+		res, err := transport.RoundTrip(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("transport.RoundTrip() failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("transport.RoundTrip() buffered the tarball")
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned for requests to an upstream registry whose
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// monitorWindow is the number of recent requests that latency percentiles and
+// error rates are computed from.
+const monitorWindow = 100
+
+// UpstreamLatency contains latency percentiles of recent requests in
+// milliseconds.
+type UpstreamLatency struct {
+	P50 float64
+	P90 float64
+	P99 float64
+}
+
+// UpstreamFailure describes the most recent failed request.
+type UpstreamFailure struct {
+	Time  time.Time
+	Error string
+}
+
+// upstreamSample is the outcome of a single request.
+type upstreamSample struct {
+	latency time.Duration
+	failed  bool
+}
+
+// upstreamMonitor tracks the outcome of requests to an upstream registry and
+// implements a circuit breaker. After threshold consecutive failures, the
+// breaker opens and requests fail immediately. Once cooldown has passed, a
+// single request is let through; the breaker closes if it succeeds. A
+// threshold of zero disables the breaker.
+type upstreamMonitor struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu          sync.Mutex
+	samples     []upstreamSample
+	next        int
+	lastFailure *UpstreamFailure
+	checked     bool
+	checkErr    error
+
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// newUpstreamMonitor creates a monitor with a closed breaker.
+func newUpstreamMonitor(threshold int, cooldown time.Duration) *upstreamMonitor {
+	return &upstreamMonitor{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+	}
+}
+
+// allow checks if a request may be sent to the upstream registry.
+func (m *upstreamMonitor) allow() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch m.state {
+	case BreakerOpen:
+		if time.Since(m.openedAt) < m.cooldown {
+			return false
+		}
+		m.state = BreakerHalfOpen
+		m.probing = true
+		return true
+	case BreakerHalfOpen:
+		if m.probing {
+			return false
+		}
+		m.probing = true
+	}
+	return true
+}
+
+// record tracks the outcome of a request and updates the breaker.
+func (m *upstreamMonitor) record(latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sample := upstreamSample{latency, err != nil}
+	if len(m.samples) < monitorWindow {
+		m.samples = append(m.samples, sample)
+	} else {
+		m.samples[m.next] = sample
+		m.next = (m.next + 1) % monitorWindow
+	}
+
+	if err == nil {
+		m.state = BreakerClosed
+		m.failures = 0
+		m.probing = false
+		return
+	}
+	m.lastFailure = &UpstreamFailure{time.Now(), err.Error()}
+	m.failures++
+	if m.threshold > 0 &&
+		(m.state == BreakerHalfOpen || m.failures >= m.threshold) {
+		m.state = BreakerOpen
+		m.openedAt = time.Now()
+		m.probing = false
+	}
+}
+
+// recordCheck tracks the outcome of a health check.
+func (m *upstreamMonitor) recordCheck(latency time.Duration, err error) {
+	m.record(latency, err)
+	m.mu.Lock()
+	m.checked = true
+	m.checkErr = err
+	m.mu.Unlock()
+}
+
+// wasChecked checks if the upstream registry has been health checked before.
+func (m *upstreamMonitor) wasChecked() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checked
+}
+
+// fill adds the tracked statistics to the supplied status.
+func (m *upstreamMonitor) fill(status *UpstreamStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status.Status = "up"
+	if m.checkErr != nil || m.state == BreakerOpen {
+		status.Status = "down"
+	}
+	status.Breaker = m.state
+	status.LastFailure = m.lastFailure
+	if len(m.samples) == 0 {
+		return
+	}
+
+	latencies := make([]time.Duration, len(m.samples))
+	failed := 0
+	for i, sample := range m.samples {
+		latencies[i] = sample.latency
+		if sample.failed {
+			failed++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	status.Latency = &UpstreamLatency{
+		P50: percentile(latencies, 0.5),
+		P90: percentile(latencies, 0.9),
+		P99: percentile(latencies, 0.99),
+	}
+	status.ErrorRate = float64(failed) / float64(len(m.samples))
+}
+
+// percentile returns the p-th percentile of the sorted latencies in
+// milliseconds.
+func percentile(latencies []time.Duration, p float64) float64 {
+	i := int(p*float64(len(latencies)) + 0.5)
+	if i > 0 {
+		i--
+	}
+	return float64(latencies[i]) / float64(time.Millisecond)
+}
+
+// monitoringTransport records the outcome of requests to the upstream
+// registry and rejects requests while the circuit breaker is open. Server
+// errors count as failures.
+type monitoringTransport struct {
+	next    http.RoundTripper
+	monitor *upstreamMonitor
+}
+
+// RoundTrip sends the request unless the circuit breaker is open.
+func (t *monitoringTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.monitor.allow() {
+		return nil, ErrCircuitOpen
+	}
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		t.monitor.record(time.Since(start), err)
+	case res.StatusCode >= http.StatusInternalServerError:
+		t.monitor.record(time.Since(start), errors.New(res.Status))
+	default:
+		t.monitor.record(time.Since(start), nil)
+	}
+	return res, err
+}
+
+// isCircuitOpen checks if a request failed because the circuit breaker of the
+// upstream registry is open.
+func isCircuitOpen(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	return err == ErrCircuitOpen
+}
+
+// startHealthCheck pings the upstream registry every interval until Close is
+// called. A zero interval disables health checks.
+func (u *Upstream) startHealthCheck(interval time.Duration) {
+	if interval == 0 {
+		return
+	}
+	stop := make(chan struct{})
+	u.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			u.check(interval)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// check pings the upstream registry and records the result.
+func (u *Upstream) check(timeout time.Duration) error {
+	start := time.Now()
+	err := u.PingTimeout(timeout)
+	u.monitor.recordCheck(time.Since(start), err)
+	return err
+}
+
+// Close stops the health checks of the upstream registry.
+func (u *Upstream) Close() {
+	if u.stop != nil {
+		close(u.stop)
+		u.stop = nil
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamMonitorBreaker(t *testing.T) {
+	m := newUpstreamMonitor(2, time.Hour)
+	failure := errors.New("connection refused")
+
+	m.record(time.Millisecond, failure)
+	if !m.allow() || m.state != BreakerClosed {
+		t.Errorf("state = %v; want %v after one failure", m.state, BreakerClosed)
+	}
+	m.record(time.Millisecond, failure)
+	if m.allow() || m.state != BreakerOpen {
+		t.Errorf("state = %v; want %v after two failures", m.state, BreakerOpen)
+	}
+
+	// After the cooldown, a single request is let through.
+	m.openedAt = m.openedAt.Add(-time.Hour)
+	if !m.allow() || m.state != BreakerHalfOpen {
+		t.Errorf("state = %v; want %v after cooldown", m.state, BreakerHalfOpen)
+	}
+	if m.allow() {
+		t.Errorf("m.allow() = true; want false while probing")
+	}
+	m.record(time.Millisecond, failure)
+	if m.state != BreakerOpen {
+		t.Errorf("state = %v; want %v after failed probe", m.state, BreakerOpen)
+	}
+
+	m.openedAt = m.openedAt.Add(-time.Hour)
+	m.allow()
+	m.record(time.Millisecond, nil)
+	if !m.allow() || m.state != BreakerClosed {
+		t.Errorf("state = %v; want %v after successful probe", m.state, BreakerClosed)
+	}
+}
+
+func TestUpstreamMonitorDisabledBreaker(t *testing.T) {
+	m := newUpstreamMonitor(0, time.Hour)
+	for i := 0; i < 10; i++ {
+		m.record(time.Millisecond, errors.New("connection refused"))
+	}
+	if !m.allow() {
+		t.Errorf("m.allow() = false; want true with disabled breaker")
+	}
+}
+
+func TestUpstreamMonitorStats(t *testing.T) {
+	m := newUpstreamMonitor(0, 0)
+	for i := 1; i <= 100; i++ {
+		var err error
+		if i%10 == 0 {
+			err = errors.New("bad gateway")
+		}
+		m.record(time.Duration(i)*time.Millisecond, err)
+	}
+
+	status := &UpstreamStatus{}
+	m.fill(status)
+	want := UpstreamLatency{P50: 50, P90: 90, P99: 99}
+	if *status.Latency != want {
+		t.Errorf("status.Latency = %+v; want %+v", *status.Latency, want)
+	}
+	if status.ErrorRate != 0.1 {
+		t.Errorf("status.ErrorRate = %v; want %v", status.ErrorRate, 0.1)
+	}
+	if status.LastFailure == nil || status.LastFailure.Error != "bad gateway" {
+		t.Errorf("status.LastFailure = %+v; want %q", status.LastFailure, "bad gateway")
+	}
+	if status.Breaker != BreakerClosed {
+		t.Errorf("status.Breaker = %v; want %v", status.Breaker, BreakerClosed)
+	}
+}
+
+func TestUpstreamsHandleReqCircuitOpen(t *testing.T) {
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	upstreams := createUpstreams([]*UpstreamConfig{
+		{URL: server.URL, FailureThreshold: 1, BreakerCooldown: time.Hour},
+	}, t)
+
+	codes := []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+	for _, code := range codes {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/tape?:name=tape", nil)
+		if err := upstreams.HandleReq(w, req, createBaseURL("http://127.0.0.1:8200", t), nil); err != nil {
+			t.Errorf("upstreams.HandleReq() failed: %v", err)
+		}
+		if w.Code != code {
+			t.Errorf("w.Code = %v; want %v", w.Code, code)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("hits = %v; want %v", hits, 1)
+	}
+}
+
+func TestUpstreamCheckServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	upstreams := createUpstreams([]*UpstreamConfig{
+		{URL: server.URL, FailureThreshold: 2, BreakerCooldown: time.Hour},
+	}, t)
+	u := upstreams[0]
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/tape?:name=tape", nil)
+		if err := upstreams.HandleReq(w, req, createBaseURL("http://127.0.0.1:8200", t), nil); err != nil {
+			t.Errorf("upstreams.HandleReq() failed: %v", err)
+		}
+	}
+	if u.monitor.state != BreakerOpen {
+		t.Fatalf("state = %v; want %v after two 503s", u.monitor.state, BreakerOpen)
+	}
+
+	// A health check answered with a 503 must not close the breaker again.
+	if err := u.check(time.Second); err == nil {
+		t.Errorf("u.check() = %v; want error", err)
+	}
+	if u.monitor.state != BreakerOpen {
+		t.Errorf("state = %v; want %v after failed health check", u.monitor.state, BreakerOpen)
+	}
+	if u.monitor.allow() {
+		t.Errorf("u.monitor.allow() = true; want false")
+	}
+}
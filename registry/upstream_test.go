@@ -21,7 +21,11 @@
 package registry
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func createUpstream(url string, t *testing.T) *Upstream {
@@ -51,3 +55,351 @@ func TestGetStatusDown(t *testing.T) {
 		t.Errorf("status.URL = %v; want %v", status.URL, url)
 	}
 }
+
+var upstreamMatchesTests = []struct {
+	match   []string
+	name    string
+	matches bool
+}{
+	{nil, "tape", true},
+	{nil, "@partner/tape", true},
+	{[]string{"@partner/*"}, "@partner/tape", true},
+	{[]string{"@partner/*"}, "@other/tape", false},
+	{[]string{"@partner/*"}, "tape", false},
+	{[]string{"*"}, "tape", true},
+	{[]string{"*"}, "@partner/tape", false},
+	{[]string{"@*/*", "tape-*"}, "tape-run", true},
+	{[]string{"@*/*", "tape-*"}, "@other/tape", true},
+}
+
+func TestUpstreamMatches(t *testing.T) {
+	for _, tt := range upstreamMatchesTests {
+		u := &Upstream{Match: tt.match}
+		if matches := u.Matches(tt.name); matches != tt.matches {
+			t.Errorf("Upstream{Match: %q}.Matches(%q) = %t; want %t", tt.match, tt.name, matches, tt.matches)
+		}
+	}
+}
+
+func TestUpstreamHandleReqStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-End", "1")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	upstream := createUpstream(server.URL, t)
+
+	req := httptest.NewRequest("GET", "/tape", nil)
+	w := httptest.NewRecorder()
+	upstream.HandleReq(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("w.Code = %v; want %v", w.Code, http.StatusNotFound)
+	}
+	for _, key := range []string{"Connection", "X-Hop", "Keep-Alive"} {
+		if value := w.Header().Get(key); value != "" {
+			t.Errorf("w.Header().Get(%q) = %q; want %q", key, value, "")
+		}
+	}
+	if value := w.Header().Get("X-End"); value != "1" {
+		t.Errorf("w.Header().Get(%q) = %q; want %q", "X-End", value, "1")
+	}
+}
+
+func TestUpstreamFetchHeaders(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+	}))
+	defer server.Close()
+	upstream := createUpstream(server.URL, t)
+
+	req := httptest.NewRequest("GET", "/tape", nil)
+	req.Header.Set("Accept", "application/vnd.npm.install-v1+json")
+	req.Header.Set("Npm-Session", "abc")
+	req.Header.Set("Cookie", "secret")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("Authorization", "Bearer client")
+	res, err := upstream.Fetch(req)
+	if err != nil {
+		t.Fatalf("upstream.Fetch() failed: %v", err)
+	}
+	res.Body.Close()
+
+	for key, want := range map[string]string{
+		"Accept":          "application/vnd.npm.install-v1+json",
+		"Npm-Session":     "abc",
+		"Cookie":          "",
+		"X-Forwarded-For": "",
+		"Authorization":   "",
+	} {
+		if value := header.Get(key); value != want {
+			t.Errorf("header.Get(%q) = %q; want %q", key, value, want)
+		}
+	}
+
+	upstream.ForwardAuth = true
+	res, err = upstream.Fetch(req)
+	if err != nil {
+		t.Fatalf("upstream.Fetch() failed: %v", err)
+	}
+	res.Body.Close()
+	if value, want := header.Get("Authorization"), "Bearer client"; value != want {
+		t.Errorf("header.Get(%q) with ForwardAuth = %q; want %q", "Authorization", value, want)
+	}
+}
+
+func TestUpstreamFetchRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	upstream := createUpstream(server.URL, t)
+	upstream.Retries = 2
+	upstream.RetryBackoff = time.Millisecond
+
+	req := httptest.NewRequest("GET", "/tape", nil)
+	res, err := upstream.Fetch(req)
+	if err != nil {
+		t.Fatalf("upstream.Fetch() failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("res.StatusCode = %v; want %v", res.StatusCode, http.StatusOK)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %v; want %v", attempts, 3)
+	}
+
+	attempts = 0
+	req = httptest.NewRequest("PUT", "/tape", nil)
+	res, err = upstream.Fetch(req)
+	if err != nil {
+		t.Fatalf("upstream.Fetch() failed: %v", err)
+	}
+	res.Body.Close()
+	if attempts != 1 {
+		t.Errorf("attempts = %v; want %v", attempts, 1)
+	}
+}
+
+func TestRegistryHandleUpstreamReserved(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requested = true
+	}))
+	defer server.Close()
+
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	r.config.ReservedNames = []string{"@ourcompany/*"}
+	r.upstreams = Upstreams{createUpstream(server.URL, t)}
+
+	tests := []struct {
+		url       string
+		code      int
+		requested bool
+	}{
+		{"/@ourcompany/auth?:scope=ourcompany&:name=auth", http.StatusNotFound, false},
+		{"/@ourcompany/auth/-/auth-1.0.0.tgz?:scope=ourcompany&:name=auth&:file=auth-1.0.0.tgz", http.StatusNotFound, false},
+		{"/@other/auth?:scope=other&:name=auth", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		requested = false
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tt.url, nil)
+		if err := r.HandleUpstream(w, req); err != nil {
+			t.Errorf("r.HandleUpstream(%v) failed: %v", tt.url, err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("r.HandleUpstream(%v) code = %v; want %v", tt.url, w.Code, tt.code)
+		}
+		if requested != tt.requested {
+			t.Errorf("r.HandleUpstream(%v) requested upstream = %t; want %t", tt.url, requested, tt.requested)
+		}
+	}
+}
+
+func TestRegistryHandleUpstreamPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("tarball"))
+	}))
+	defer server.Close()
+
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	r.config.VerifyUpstreamIntegrity = false
+	r.upstreams = Upstreams{createUpstream(server.URL, t)}
+	r.policy = &PolicyFile{
+		policy: createPolicy(&Policy{
+			Rules: []*PolicyRule{{Action: PolicyDeny, Name: "event-stream", Versions: "3.3.6"}},
+		}, t),
+		checkedAt: time.Now().Add(time.Hour),
+	}
+
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"/event-stream/-/event-stream-3.3.6.tgz?:name=event-stream&:file=event-stream-3.3.6.tgz", http.StatusForbidden},
+		{"/event-stream/-/event-stream-3.3.5.tgz?:name=event-stream&:file=event-stream-3.3.5.tgz", http.StatusOK},
+		{"/event-stream/-/event-stream-3.3.6-beta.tgz?:name=event-stream&:file=event-stream-3.3.6-beta.tgz", http.StatusForbidden},
+		{"/event-stream/-/renamed.tgz?:name=event-stream&:file=renamed.tgz", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tt.url, nil)
+		if err := r.HandleUpstream(w, req); err != nil {
+			t.Errorf("r.HandleUpstream(%v) failed: %v", tt.url, err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("r.HandleUpstream(%v) code = %v; want %v", tt.url, w.Code, tt.code)
+		}
+	}
+}
+
+func TestRegistryUpstreamTarballRoute(t *testing.T) {
+	requested := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requested = req.URL.Path
+		w.Write([]byte("tarball"))
+	}))
+	defer server.Close()
+
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	r.config.VerifyUpstreamIntegrity = false
+	r.upstreams = Upstreams{createUpstream(server.URL+"/api/npm", t)}
+
+	tests := []struct {
+		url       string
+		code      int
+		requested string
+	}{
+		{"/-/upstream/tape/-/api/npm/tape/-/tape-4.6.0.tgz", http.StatusOK, "/api/npm/tape/-/tape-4.6.0.tgz"},
+		{"/-/upstream/@partner/tape/-/@partner/tape/-/tape-1.0.0.tgz", http.StatusOK, "/@partner/tape/-/tape-1.0.0.tgz"},
+		{"/-/upstream/tape/-/../../tape/-/tape-4.6.0.tgz", http.StatusOK, "/tape/-/tape-4.6.0.tgz"},
+		{"/-/upstream/tape/-/files/tape-4.6.0.tgz", http.StatusNotFound, ""},
+		{"/-/upstream/tape/-/../../secret.tgz", http.StatusNotFound, ""},
+		{"/-/upstream/tape/-/denied/-/denied-1.0.0.tgz", http.StatusNotFound, ""},
+		{"/-/upstream/tape/-/denied/-/tape-1.0.0.tgz", http.StatusNotFound, ""},
+		{"/-/upstream/tape/-/@ourcompany/tape/-/tape-1.0.0.tgz", http.StatusNotFound, ""},
+		{"/-/upstream/tape/-/tape/-/tape-.tgz", http.StatusNotFound, ""},
+		{"/-/upstream/tape/-/tape/-/sub/tape-1.0.0.tgz", http.StatusNotFound, ""},
+		{"/-/upstream/tape/-/tape/package.json", http.StatusNotFound, ""},
+		{"/tape/-/tape-4.6.0.tgz", http.StatusOK, "/api/npm/tape/-/tape-4.6.0.tgz"},
+	}
+	for _, tt := range tests {
+		requested = ""
+		w := httptest.NewRecorder()
+		r.mux.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("GET %v code = %v; want %v", tt.url, w.Code, tt.code)
+		}
+		if requested != tt.requested {
+			t.Errorf("GET %v requested %q upstream; want %q", tt.url, requested, tt.requested)
+		}
+	}
+}
+
+func TestRegistryHandleUpstreamLicensePolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isTarballPath(req.URL.Path) {
+			w.Write([]byte("tarball"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// Abbreviated package root documents don't contain licenses.
+		if strings.Contains(req.Header.Get("Accept"), "application/vnd.npm.install-v1+json") {
+			w.Write([]byte(`{"name": "tape", "versions": {"1.0.0": {}}}`))
+			return
+		}
+		w.Write([]byte(`{"name": "tape", "versions": {"1.0.0": {"license": "AGPL-3.0"}}}`))
+	}))
+	defer server.Close()
+
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	r.config.VerifyUpstreamIntegrity = false
+	r.upstreams = Upstreams{createUpstream(server.URL, t)}
+	r.policy = &PolicyFile{
+		policy: createPolicy(&Policy{
+			Rules: []*PolicyRule{{Action: PolicyDeny, License: []string{"AGPL-3.0"}}},
+		}, t),
+		checkedAt: time.Now().Add(time.Hour),
+	}
+
+	for _, url := range []string{
+		"/tape?:name=tape",
+		"/tape/-/tape-1.0.0.tgz?:name=tape&:file=tape-1.0.0.tgz",
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Accept", "application/vnd.npm.install-v1+json; q=1.0, application/json; q=0.8, */*")
+		if err := r.HandleUpstream(w, req); err != nil {
+			t.Errorf("r.HandleUpstream(%v) failed: %v", url, err)
+		}
+		if w.Code != http.StatusForbidden {
+			t.Errorf("r.HandleUpstream(%v) code = %v; want %v", url, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestGetTarballVersion(t *testing.T) {
+	tests := []struct {
+		name, file, version string
+	}{
+		{"tape", "tape-4.6.0.tgz", "4.6.0"},
+		{"@partner/tape", "tape-1.0.0-beta.1.tgz", "1.0.0-beta.1"},
+		{"tape", "other-1.0.0.tgz", ""},
+		{"tape", "tape-1.0.0.tar", ""},
+	}
+	for _, tt := range tests {
+		if version := getTarballVersion(tt.name, tt.file); version != tt.version {
+			t.Errorf("getTarballVersion(%q, %q) = %q; want %q", tt.name, tt.file, version, tt.version)
+		}
+	}
+}
+
+func TestRegistryNoUpstream(t *testing.T) {
+	r, cleanup := createTestRegistry(t)
+	defer cleanup()
+	config := *r.config
+	config.NoUpstream = true
+	if err := r.Reload(&config); err != nil {
+		t.Fatalf("r.Reload() failed: %v", err)
+	}
+
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"/tape?:name=tape", http.StatusNotFound},
+		{"/tape/-/tape-1.0.0.tgz?:name=tape&:file=tape-1.0.0.tgz", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tt.url, nil)
+		if err := r.HandleUpstream(w, req); err != nil {
+			t.Errorf("r.HandleUpstream(%v) failed: %v", tt.url, err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("r.HandleUpstream(%v) code = %v; want %v", tt.url, w.Code, tt.code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if err := r.HandleUpstreams(w, httptest.NewRequest("GET", "/-/upstreams", nil)); err != nil {
+		t.Errorf("r.HandleUpstreams() failed: %v", err)
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("r.HandleUpstreams() code = %v; want %v", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/alexanderGugel/nerva/util"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Upstreams is an ordered list of upstream registries. Requests for a package
+// are forwarded to the first upstream whose match rules accept the package
+// name. If that upstream doesn't know about the package, the next matching
+// upstream is tried.
+type Upstreams []*Upstream
+
+// PkgRootFilter modifies package root documents of upstream registries before
+// they are returned to the client. If it returns false, the package is
+// refused.
+type PkgRootFilter func(req *http.Request, name string, doc map[string]interface{}) bool
+
+// NewUpstreams instantiates registry proxies for the supplied upstream
+// configurations. If cache is not nil, responses of all upstream registries
+// are cached. Concurrent identical requests are coalesced.
+func NewUpstreams(configs []*UpstreamConfig, cache *UpstreamCache) (Upstreams, error) {
+	upstreams := Upstreams{}
+	for _, config := range configs {
+		upstream, err := NewUpstreamFromConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		var transport http.RoundTripper = &verifyingTransport{upstream.Transport}
+		if cache != nil {
+			transport = cache.wrap(transport, upstream.authenticated)
+		}
+		coalescing, err := newCoalescingTransport(transport, config.NotFoundTTL)
+		if err != nil {
+			return nil, err
+		}
+		upstream.Client.Transport = coalescing
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// Matching returns all upstreams that packages with the given name should be
+// requested from, in order.
+func (us Upstreams) Matching(name string) Upstreams {
+	matching := Upstreams{}
+	for _, u := range us {
+		if u.Matches(name) {
+			matching = append(matching, u)
+		}
+	}
+	return matching
+}
+
+// HandleReq forwards the request to the matching upstreams until one of them
+// has the requested package. The response of the last upstream is returned
+// if none of them has it. Tarball URLs in package root documents are rewritten
+// to point to base, so that clients download them through nerva. If
+// filter is not nil, it is applied to package root documents.
+//
+// Upstreams in redirect mode are terminal: the client is redirected to the
+// first of them that is reached, since nerva can't tell whether it has the
+// package without proxying the request.
+func (us Upstreams) HandleReq(w http.ResponseWriter, req *http.Request,
+	base *BaseURL, filter PkgRootFilter) error {
+	name := getPkgName(req)
+	matching := us.Matching(name)
+	if len(matching) == 0 {
+		return respondPkgNotFound(w)
+	}
+
+	contextLog := util.ContextLog(req, log.StandardLogger())
+	for i, u := range matching {
+		if u.Mode == UpstreamModeRedirect {
+			u.Redirect(w, req)
+			return nil
+		}
+		last := i == len(matching)-1
+		res, err := u.Fetch(req)
+		if err != nil {
+			if last && isCircuitOpen(err) {
+				code := http.StatusServiceUnavailable
+				res := &util.ErrorResponse{
+					http.StatusText(code),
+					"upstream unavailable",
+				}
+				return util.RespondJSON(w, code, res)
+			}
+			if last {
+				return err
+			}
+			util.LogWarn(contextLog.WithFields(log.Fields{
+				"upstream": u.URL.String(),
+			}), err, "upstream failed, trying next")
+			continue
+		}
+		if res.StatusCode == http.StatusNotFound && !last {
+			res.Body.Close()
+			continue
+		}
+		if isUpstreamPkgRoot(req, res) {
+			return writeUpstreamPkgRoot(w, req, res, name, base, filter)
+		}
+		if res.StatusCode == http.StatusNotModified && !isTarballPath(req.URL.Path) {
+			weakenETag(res.Header)
+		}
+		return writeUpstreamRes(w, res)
+	}
+	return nil
+}
+
+// FetchPkgRoot retrieves the root document of the named package from the
+// first matching upstream registry that has it. Upstreams in redirect mode are
+// skipped.
+func (us Upstreams) FetchPkgRoot(req *http.Request, name string) (map[string]interface{}, error) {
+	rootReq, err := http.NewRequest(http.MethodGet, "/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	rootReq = rootReq.WithContext(withHostPath(req.Context(), false))
+	copyHeader(rootReq.Header, req.Header)
+	rootReq.Header.Del("If-None-Match")
+	rootReq.Header.Del("If-Modified-Since")
+
+	for _, u := range us.Matching(name) {
+		if u.Mode == UpstreamModeRedirect {
+			continue
+		}
+		res, err := u.Fetch(rootReq)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusNotFound {
+			res.Body.Close()
+			continue
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("upstream %v responded with %v", u.URL,
+				res.Status)
+		}
+		doc := map[string]interface{}{}
+		err = json.NewDecoder(res.Body).Decode(&doc)
+		return doc, err
+	}
+	return nil, fmt.Errorf("package %v not found upstream", name)
+}
+
+// Close stops the health checks of all upstream registries.
+func (us Upstreams) Close() {
+	for _, u := range us {
+		u.Close()
+	}
+}
+
+// GetStatus returns the current status of all upstream registries.
+func (us Upstreams) GetStatus() []*UpstreamStatus {
+	statuses := []*UpstreamStatus{}
+	for _, u := range us {
+		statuses = append(statuses, u.GetStatus())
+	}
+	return statuses
+}
+
+// isTarballPath checks if the supplied URL path refers to a package tarball.
+func isTarballPath(urlPath string) bool {
+	return strings.HasSuffix(urlPath, ".tgz")
+}
+
+// isUpstreamPkgRoot checks if the supplied response of an upstream registry is
+// a package root document.
+func isUpstreamPkgRoot(req *http.Request, res *http.Response) bool {
+	return res.StatusCode == http.StatusOK &&
+		!isTarballPath(req.URL.Path) &&
+		strings.Contains(res.Header.Get("Content-Type"), "json")
+}
+
+// writeUpstreamPkgRoot copies a package root document of an upstream registry
+// and rewrites its tarball URLs.
+func writeUpstreamPkgRoot(w http.ResponseWriter, req *http.Request,
+	res *http.Response, name string, base *BaseURL,
+	filter PkgRootFilter) error {
+	defer res.Body.Close()
+	doc := map[string]interface{}{}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return err
+	}
+	if filter != nil && !filter(req, name, doc) {
+		return respondBlocked(w)
+	}
+	rewriteTarballURLs(doc, name, base)
+
+	copyResHeader(w.Header(), res.Header)
+	// The document has been modified, so the original length no longer applies
+	// and the ETag is only semantically equivalent.
+	w.Header().Del("Content-Length")
+	weakenETag(w.Header())
+	return util.RespondJSON(w, res.StatusCode, doc)
+}
+
+// weakenETag marks the ETag of a rewritten package root document as weak.
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// rewriteTarballURLs rewrites the tarball URLs of all versions in the supplied
+// package root document to point to base. The rewritten URLs are handled by
+// the upstream tarball route and keep the tarball's path on the upstream
+// registry, since registries don't necessarily serve tarballs at
+// "/name/-/file".
+func rewriteTarballURLs(doc map[string]interface{}, name string,
+	base *BaseURL) {
+	versions, ok := doc["versions"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, version := range versions {
+		version, ok := version.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		dist, ok := version["dist"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tarball, ok := dist["tarball"].(string)
+		if !ok {
+			continue
+		}
+		tarballURL, err := url.Parse(tarball)
+		if err != nil {
+			continue
+		}
+		dist["tarball"] = base.UpstreamTarball(name, tarballURL.Path)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func createUpstreamServer(code int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}))
+}
+
+func createUpstreams(configs []*UpstreamConfig, t *testing.T) Upstreams {
+	upstreams, err := NewUpstreams(configs, nil)
+	if err != nil {
+		t.Fatalf("NewUpstreams(%v) failed: %v", configs, err)
+	}
+	return upstreams
+}
+
+func TestUpstreamsHandleReqScope(t *testing.T) {
+	partner := createUpstreamServer(http.StatusOK, "partner")
+	defer partner.Close()
+	public := createUpstreamServer(http.StatusOK, "public")
+	defer public.Close()
+
+	upstreams := createUpstreams([]*UpstreamConfig{
+		{URL: partner.URL, Match: []string{"@partner/*"}},
+		{URL: public.URL},
+	}, t)
+
+	tests := []struct {
+		url  string
+		body string
+	}{
+		{"/@partner/tape?:scope=partner&:name=tape", "partner"},
+		{"/tape?:name=tape", "public"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tt.url, nil)
+		if err := upstreams.HandleReq(w, req, createBaseURL("http://127.0.0.1:8200", t), nil); err != nil {
+			t.Errorf("upstreams.HandleReq(%v) failed: %v", tt.url, err)
+		}
+		if got := w.Body.String(); got != tt.body {
+			t.Errorf("upstreams.HandleReq(%v) body = %v; want %v", tt.url, got, tt.body)
+		}
+	}
+}
+
+func TestUpstreamsHandleReqFallthrough(t *testing.T) {
+	first := createUpstreamServer(http.StatusNotFound, "first")
+	defer first.Close()
+	second := createUpstreamServer(http.StatusOK, "second")
+	defer second.Close()
+
+	upstreams := createUpstreams([]*UpstreamConfig{
+		{URL: first.URL},
+		{URL: second.URL},
+	}, t)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/tape?:name=tape", nil)
+	if err := upstreams.HandleReq(w, req, createBaseURL("http://127.0.0.1:8200", t), nil); err != nil {
+		t.Errorf("upstreams.HandleReq() failed: %v", err)
+	}
+	if got := w.Body.String(); got != "second" {
+		t.Errorf("w.Body.String() = %v; want %v", got, "second")
+	}
+}
+
+func TestUpstreamsHandleReqRedirect(t *testing.T) {
+	upstreams := createUpstreams([]*UpstreamConfig{
+		{URL: "http://registry.npmjs.com/npm", Mode: UpstreamModeRedirect},
+		{URL: "http://localhost:8080"},
+	}, t)
+
+	tests := []struct {
+		method   string
+		url      string
+		code     int
+		location string
+	}{
+		{"GET", "/tape?:name=tape", http.StatusFound, "http://registry.npmjs.com/npm/tape"},
+		{"GET", "/@partner/tape?:scope=partner&:name=tape", http.StatusFound, "http://registry.npmjs.com/npm/@partner/tape"},
+		{"PUT", "/tape?:name=tape", http.StatusTemporaryRedirect, "http://registry.npmjs.com/npm/tape"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		if err := upstreams.HandleReq(w, req, createBaseURL("http://127.0.0.1:8200", t), nil); err != nil {
+			t.Errorf("upstreams.HandleReq(%v) failed: %v", tt.url, err)
+		}
+		if w.Code != tt.code {
+			t.Errorf("%v %v: w.Code = %v; want %v", tt.method, tt.url, w.Code, tt.code)
+		}
+		if location := w.Header().Get("Location"); location != tt.location {
+			t.Errorf("%v %v: Location = %v; want %v", tt.method, tt.url, location, tt.location)
+		}
+	}
+}
+
+func TestUpstreamsHandleReqNoMatch(t *testing.T) {
+	upstreams := createUpstreams([]*UpstreamConfig{
+		{URL: "http://localhost:8080", Match: []string{"@partner/*"}},
+	}, t)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/tape?:name=tape", nil)
+	if err := upstreams.HandleReq(w, req, createBaseURL("http://127.0.0.1:8200", t), nil); err != nil {
+		t.Errorf("upstreams.HandleReq() failed: %v", err)
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("w.Code = %v; want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestUpstreamsHandleReqRewritesTarballs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"name": "tape",
+			"versions": {
+				"4.6.0": {
+					"dist": {
+						"tarball": "https://registry.npmjs.org/tape/-/tape-4.6.0.tgz"
+					}
+				}
+			}
+		}`))
+	}))
+	defer server.Close()
+
+	upstreams := createUpstreams([]*UpstreamConfig{{URL: server.URL}}, t)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/tape?:name=tape", nil)
+	if err := upstreams.HandleReq(w, req, createBaseURL("http://127.0.0.1:8200", t), nil); err != nil {
+		t.Fatalf("upstreams.HandleReq() failed: %v", err)
+	}
+
+	doc := struct {
+		Versions map[string]struct {
+			Dist PackageDist `json:"dist"`
+		} `json:"versions"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("json.Unmarshal(%v) failed: %v", w.Body.String(), err)
+	}
+	want := "http://127.0.0.1:8200/-/upstream/tape/-/tape/-/tape-4.6.0.tgz"
+	if got := doc.Versions["4.6.0"].Dist.Tarball; got != want {
+		t.Errorf("tarball = %v; want %v", got, want)
+	}
+}
+
+var rewriteTarballURLsTests = []struct {
+	name    string
+	front   string
+	tarball string
+	want    string
+}{
+	{"tape", "http://front", "https://registry.npmjs.org/tape/-/tape-4.6.0.tgz", "http://front/-/upstream/tape/-/tape/-/tape-4.6.0.tgz"},
+	{"@partner/tape", "http://front", "https://npm.partner.com/@partner/tape/-/tape-1.0.0.tgz", "http://front/-/upstream/@partner/tape/-/@partner/tape/-/tape-1.0.0.tgz"},
+	{"tape", "https://tools.corp/npm/", "https://registry.npmjs.org/tape/-/tape-4.6.0.tgz", "https://tools.corp/npm/-/upstream/tape/-/tape/-/tape-4.6.0.tgz"},
+	{"tape", "http://front", "https://gitlab.corp/api/v4/packages/npm/tape/-/tape-1.0.0.tgz", "http://front/-/upstream/tape/-/api/v4/packages/npm/tape/-/tape-1.0.0.tgz"},
+}
+
+func TestRewriteTarballURLs(t *testing.T) {
+	for _, tt := range rewriteTarballURLsTests {
+		dist := map[string]interface{}{"tarball": tt.tarball}
+		doc := map[string]interface{}{
+			"versions": map[string]interface{}{
+				"1.0.0": map[string]interface{}{"dist": dist},
+			},
+		}
+		rewriteTarballURLs(doc, tt.name, createBaseURL(tt.front, t))
+		if got := dist["tarball"]; got != tt.want {
+			t.Errorf("rewriteTarballURLs(%v) = %v; want %v", tt.tarball, got, tt.want)
+		}
+	}
+}
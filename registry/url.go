@@ -0,0 +1,119 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BaseURL builds the absolute URLs of registry resources, e.g. of package
+// roots and tarballs. The base URL may contain a path prefix, in which case
+// nerva is expected to be hosted at that sub-path.
+type BaseURL struct {
+	url url.URL
+}
+
+// NewBaseURL parses the supplied base URL, e.g. "https://tools.corp/npm/".
+func NewBaseURL(raw string) (*BaseURL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("base URL must be an http or https URL")
+	}
+	if u.Host == "" {
+		return nil, errors.New("base URL must contain a host")
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.New("base URL must not contain user info, query or fragment")
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return &BaseURL{*u}, nil
+}
+
+// String returns the base URL without trailing slash.
+func (b *BaseURL) String() string {
+	return b.url.String()
+}
+
+// Prefix returns the path prefix of the base URL without trailing slash, or
+// an empty string if there is none.
+func (b *BaseURL) Prefix() string {
+	return b.url.Path
+}
+
+// PkgRoot returns the URL of the package root document of the named package.
+func (b *BaseURL) PkgRoot(name string) string {
+	return b.resolve(name)
+}
+
+// Tarball returns the URL of the named package's tarball "file".
+func (b *BaseURL) Tarball(name string, file string) string {
+	return b.resolve(name, "-", file)
+}
+
+// UpstreamTarball returns the URL nerva serves the named package's tarball of
+// an upstream registry at. p is the path of the tarball on the upstream
+// registry's host.
+func (b *BaseURL) UpstreamTarball(name string, p string) string {
+	return b.resolve("-", "upstream", name, "-", strings.TrimPrefix(p, "/"))
+}
+
+// resolve joins the supplied path elements to the base URL. Elements are
+// escaped, but may contain slashes (e.g. scoped package names).
+func (b *BaseURL) resolve(elem ...string) string {
+	u := b.url
+	u.Path += "/" + strings.Join(elem, "/")
+	return u.String()
+}
+
+// mountHandler serves handler under the path prefix returned by prefix. The
+// prefix is stripped from the request path before the request is passed on,
+// requests outside of the prefix result in a 404.
+func mountHandler(prefix func() string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := prefix()
+		if p == "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		rest := strings.TrimPrefix(req.URL.Path, p)
+		if len(rest) == len(req.URL.Path) || (rest != "" && rest[0] != '/') {
+			http.NotFound(w, req)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		r2 := new(http.Request)
+		*r2 = *req
+		r2.URL = new(url.URL)
+		*r2.URL = *req.URL
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		handler.ServeHTTP(w, r2)
+	})
+}
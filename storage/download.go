@@ -34,20 +34,10 @@ type Download struct {
 	Prefix string
 }
 
-// NewDownload creates a new download.
+// NewDownload creates a new download. See PeelTree for the returned errors.
 func NewDownload(repo *git.Repository, id *git.Oid) (*Download, error) {
-	ref, err := repo.Lookup(id)
-	if err != nil || ref == nil {
-		return nil, err
-	}
-
-	treeObject, err := ref.Peel(git.ObjectTree)
-	if err != nil || treeObject == nil {
-		return nil, err
-	}
-
-	tree, err := treeObject.AsTree()
-	if err != nil || tree == nil {
+	tree, err := PeelTree(repo, id)
+	if err != nil {
 		return nil, err
 	}
 
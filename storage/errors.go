@@ -0,0 +1,84 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"github.com/libgit2/git2go"
+)
+
+var (
+	// ErrPackageNotFound is returned when there is no repository for the
+	// requested package.
+	ErrPackageNotFound = errors.New("package not found")
+	// ErrVersionNotFound is returned when the requested version does not refer
+	// to an object in the package's repository.
+	ErrVersionNotFound = errors.New("version not found")
+	// ErrCorruptRepo is returned when a repository exists, but can't be read.
+	ErrCorruptRepo = errors.New("corrupt repository")
+	// ErrInvalidName is returned for package names that don't refer to a
+	// sub-directory of the storage directory.
+	ErrInvalidName = errors.New("invalid package name")
+)
+
+// Error records a failed storage operation. Kind is one of the Err* values
+// defined by this package, Err is the underlying error (if any).
+type Error struct {
+	Kind error
+	Name string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Error()
+	if e.Name != "" {
+		msg = e.Name + ": " + msg
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Kind returns the kind of a storage error. Errors that weren't returned by
+// this package are returned unchanged.
+func Kind(err error) error {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return err
+}
+
+// IsNotFound checks if the passed in error indicates a missing package or
+// version.
+func IsNotFound(err error) bool {
+	kind := Kind(err)
+	return kind == ErrPackageNotFound || kind == ErrVersionNotFound
+}
+
+// lookupError translates an error returned by a failed object lookup.
+func lookupError(err error) error {
+	if gitErr, ok := err.(*git.GitError); ok &&
+		(gitErr.Code == git.ErrNotFound || gitErr.Class == git.ErrClassOdb) {
+		return &Error{Kind: ErrVersionNotFound, Err: err}
+	}
+	return &Error{Kind: ErrCorruptRepo, Err: err}
+}
@@ -0,0 +1,52 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	cause := errors.New("permission denied")
+	tests := []struct {
+		err      error
+		msg      string
+		kind     error
+		notFound bool
+	}{
+		{&Error{Kind: ErrPackageNotFound, Name: "tape"}, "tape: package not found", ErrPackageNotFound, true},
+		{&Error{Kind: ErrVersionNotFound}, "version not found", ErrVersionNotFound, true},
+		{&Error{Kind: ErrCorruptRepo, Name: "tape", Err: cause}, "tape: corrupt repository: permission denied", ErrCorruptRepo, false},
+		{cause, "permission denied", cause, false},
+	}
+	for _, tt := range tests {
+		if msg := tt.err.Error(); msg != tt.msg {
+			t.Errorf("err.Error() = %q; want %q", msg, tt.msg)
+		}
+		if kind := Kind(tt.err); kind != tt.kind {
+			t.Errorf("Kind(%v) = %v; want %v", tt.err, kind, tt.kind)
+		}
+		if notFound := IsNotFound(tt.err); notFound != tt.notFound {
+			t.Errorf("IsNotFound(%v) = %v; want %v", tt.err, notFound, tt.notFound)
+		}
+	}
+}
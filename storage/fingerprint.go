@@ -0,0 +1,49 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/libgit2/git2go"
+	"io"
+	"sort"
+)
+
+// RefsFingerprint returns a hash of the names and object ids of all tags in
+// the repository. It changes whenever a tag is pushed, moved or deleted, but
+// can be computed without reading any trees or blobs.
+func RefsFingerprint(repo *git.Repository) (string, error) {
+	refs := []string{}
+	if err := repo.Tags.Foreach(func(name string, id *git.Oid) error {
+		refs = append(refs, name+" "+id.String()+"\n")
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	sort.Strings(refs)
+
+	hasher := sha1.New()
+	for _, ref := range refs {
+		io.WriteString(hasher, ref)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -32,8 +32,14 @@ type ShaCache struct {
 	lru *lru.Cache
 }
 
+// shaCacheEntry holds the SHA1 sum and the size of a tarball.
+type shaCacheEntry struct {
+	shasum string
+	size   int64
+}
+
 // NewShaCache creates a new LRU cache used for mapping Git object ids to
-// respective SHA1 sums.
+// respective SHA1 sums and tarball sizes.
 func NewShaCache(size int) (*ShaCache, error) {
 	lru, err := lru.New(size)
 	if err != nil {
@@ -42,16 +48,27 @@ func NewShaCache(size int) (*ShaCache, error) {
 	return &ShaCache{lru}, nil
 }
 
-// Add populates the cache with the given Git object id.
-func (c *ShaCache) Add(id git.Oid, shasum string) bool {
-	return c.lru.Add(id, shasum)
+// Add populates the cache with the given Git object id and the SHA sum and
+// size of its tarball.
+func (c *ShaCache) Add(id git.Oid, shasum string, size int64) bool {
+	return c.lru.Add(id, shaCacheEntry{shasum, size})
 }
 
 // Get retrieves the corresponding SHA sum for the supplied Git object id.
 func (c *ShaCache) Get(id git.Oid) (string, bool) {
-	shasum, ok := c.lru.Get(id)
+	entry, ok := c.lru.Get(id)
 	if !ok {
 		return "", false
 	}
-	return shasum.(string), ok
+	return entry.(shaCacheEntry).shasum, ok
+}
+
+// Size retrieves the size of the tarball of the supplied Git object id. It
+// allows the size to be known in advance without creating the tarball.
+func (c *ShaCache) Size(id git.Oid) (int64, bool) {
+	entry, ok := c.lru.Get(id)
+	if !ok {
+		return 0, false
+	}
+	return entry.(shaCacheEntry).size, ok
 }
@@ -48,13 +48,13 @@ func TestShaCacheAdd(t *testing.T) {
 	}
 	id0 := *git.NewOidFromBytes([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	shasum0 := "shasum0"
-	if ok := c.Add(id0, shasum0); ok {
-		t.Errorf("c.Add(%v, %v) = %v; want %v", id0, shasum0, ok, false)
+	if ok := c.Add(id0, shasum0, 0); ok {
+		t.Errorf("c.Add(%v, %v, %v) = %v; want %v", id0, shasum0, 0, ok, false)
 	}
 	id1 := *git.NewOidFromBytes([]byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
 	shasum1 := "shasum1"
-	if ok := c.Add(id1, shasum1); !ok {
-		t.Errorf("c.Add(%v, %v) = %v; want %v", id1, shasum1, ok, true)
+	if ok := c.Add(id1, shasum1, 0); !ok {
+		t.Errorf("c.Add(%v, %v, %v) = %v; want %v", id1, shasum1, 0, ok, true)
 	}
 }
 
@@ -65,11 +65,26 @@ func TestShaCacheGet(t *testing.T) {
 	}
 	id := *git.NewOidFromBytes([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	shasum := "shasum"
-	if ok := c.Add(id, shasum); ok {
-		t.Errorf("c.Add(%v, %v) = %v; want %v", id, shasum, ok, false)
+	if ok := c.Add(id, shasum, 0); ok {
+		t.Errorf("c.Add(%v, %v, %v) = %v; want %v", id, shasum, 0, ok, false)
 	}
 	result, ok := c.Get(id)
 	if !ok || result != shasum {
 		t.Errorf("c.Get(%v) = %v, %v; want %v, %v", id, result, ok, shasum, true)
 	}
 }
+
+func TestShaCacheSize(t *testing.T) {
+	c, err := NewShaCache(1)
+	if err != nil {
+		t.Errorf("NewShaCache(%v) unexpected err: %v", 1, err)
+	}
+	id := *git.NewOidFromBytes([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	if size, ok := c.Size(id); ok {
+		t.Errorf("c.Size(%v) = %v, %v; want %v, %v", id, size, ok, 0, false)
+	}
+	c.Add(id, "shasum", 1024)
+	if size, ok := c.Size(id); !ok || size != 1024 {
+		t.Errorf("c.Size(%v) = %v, %v; want %v, %v", id, size, ok, 1024, true)
+	}
+}
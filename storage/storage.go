@@ -26,7 +26,8 @@ import (
 	"github.com/libgit2/git2go"
 	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
 )
 
 // Storage manages a directory of Git repositories.
@@ -48,13 +49,43 @@ func (s *Storage) init() error {
 	return os.MkdirAll(s.Dir, os.ModePerm)
 }
 
-// GetRepo opens the repository in the sub-directory "name".
+// GetRepo opens the repository in the sub-directory "name". It returns
+// ErrInvalidName if name resolves to a path outside of the storage directory,
+// ErrPackageNotFound if there is no such repository and ErrCorruptRepo if the
+// repository can't be opened.
 func (s *Storage) GetRepo(name string) (*git.Repository, error) {
-	abs := path.Join(s.Dir, name)
-	return git.OpenRepository(abs)
+	abs, err := s.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return nil, &Error{Kind: ErrPackageNotFound, Name: name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	repo, err := git.OpenRepository(abs)
+	if err != nil {
+		return nil, &Error{Kind: ErrCorruptRepo, Name: name, Err: err}
+	}
+	return repo, nil
 }
 
-// Ls lists all available repository names.
+// resolve returns the path of the repository "name". The path has to be a
+// sub-directory of the storage directory.
+func (s *Storage) resolve(name string) (string, error) {
+	abs := filepath.Join(s.Dir, name)
+	rel, err := filepath.Rel(filepath.Clean(s.Dir), abs)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &Error{Kind: ErrInvalidName, Name: name}
+	}
+	return abs, nil
+}
+
+// Ls lists all available repository names. Repositories of scoped packages
+// are stored in a directory per scope and listed as "@scope/name".
 func (s *Storage) Ls() ([]string, error) {
 	files, err := ioutil.ReadDir(s.Dir)
 	if err != nil {
@@ -64,8 +95,21 @@ func (s *Storage) Ls() ([]string, error) {
 	names := []string{}
 	for _, file := range files {
 		name := file.Name()
-		if file.IsDir() {
+		if !file.IsDir() {
+			continue
+		}
+		if !strings.HasPrefix(name, "@") {
 			names = append(names, name)
+			continue
+		}
+		scoped, err := ioutil.ReadDir(filepath.Join(s.Dir, name))
+		if err != nil {
+			continue
+		}
+		for _, file := range scoped {
+			if file.IsDir() {
+				names = append(names, name+"/"+file.Name())
+			}
 		}
 	}
 
@@ -73,21 +117,22 @@ func (s *Storage) Ls() ([]string, error) {
 }
 
 // PeelTree recursively traverses the passed in Git object until a Git tree
-// object is found.
+// object is found. It returns ErrVersionNotFound if there is no such object or
+// if the object can't be peeled to a tree.
 func PeelTree(repo *git.Repository, id *git.Oid) (*git.Tree, error) {
 	object, err := repo.Lookup(id)
 	if err != nil || object == nil {
-		return nil, err
+		return nil, lookupError(err)
 	}
 
 	treeObject, err := object.Peel(git.ObjectTree)
 	if err != nil || treeObject == nil {
-		return nil, err
+		return nil, &Error{Kind: ErrVersionNotFound, Err: err}
 	}
 
 	tree, err := treeObject.AsTree()
 	if err != nil || tree == nil {
-		return nil, err
+		return nil, &Error{Kind: ErrCorruptRepo, Err: err}
 	}
 
 	return tree, nil
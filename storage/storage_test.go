@@ -67,6 +67,29 @@ func TestLs(t *testing.T) {
 	}
 }
 
+func TestLsScoped(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	createTestRepo(filepath.Join(dir, "a"), t)
+	createTestRepo(filepath.Join(dir, "@scope", "b"), t)
+	createTestRepo(filepath.Join(dir, "@scope", "c"), t)
+	if err := os.Mkdir(filepath.Join(dir, "@empty"), 0755); err != nil {
+		t.Fatalf("os.Mkdir failed: %v", err)
+	}
+
+	storage := createStorage(dir, t)
+
+	got, err := storage.Ls()
+	want := []string{"@scope/b", "@scope/c", "a"}
+	if err != nil {
+		t.Errorf("storage.Ls() failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("storage.Ls() = %v; want %v", got, want)
+	}
+}
+
 func TestLsFailedReadDir(t *testing.T) {
 	dir := createTempDir(t)
 	defer os.RemoveAll(dir)
@@ -128,6 +151,41 @@ func TestGetRepo(t *testing.T) {
 	}
 }
 
+func TestGetRepoErrors(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "corrupt"), 0755); err != nil {
+		t.Fatalf("os.Mkdir failed: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile failed: %v", err)
+	}
+
+	storage := createStorage(dir, t)
+	tests := []struct {
+		name string
+		kind error
+	}{
+		{"missing", ErrPackageNotFound},
+		{"file", ErrPackageNotFound},
+		{"corrupt", ErrCorruptRepo},
+		{"", ErrInvalidName},
+		{"..", ErrInvalidName},
+		{"../storage_test", ErrInvalidName},
+		{"a/../..", ErrInvalidName},
+	}
+	for _, tt := range tests {
+		repo, err := storage.GetRepo(tt.name)
+		if kind := Kind(err); kind != tt.kind {
+			t.Errorf("storage.GetRepo(%v) error = %v; want %v", tt.name, kind, tt.kind)
+		}
+		if repo != nil {
+			t.Errorf("storage.GetRepo(%v) = %v; want nil", tt.name, repo)
+		}
+	}
+}
+
 func TestPeelTreeFailedLookup(t *testing.T) {
 	dir := createTempDir(t)
 	defer os.RemoveAll(dir)
@@ -136,8 +194,25 @@ func TestPeelTreeFailedLookup(t *testing.T) {
 	repo := createTestRepo(dirA, t)
 
 	var zeroID git.Oid
-	if _, err := PeelTree(repo, &zeroID); err == nil {
-		t.Errorf("PeelTree(repo, %v) did not fail", zeroID)
+	_, err := PeelTree(repo, &zeroID)
+	if kind := Kind(err); kind != ErrVersionNotFound {
+		t.Errorf("PeelTree(repo, %v) error = %v; want %v", zeroID, kind, ErrVersionNotFound)
+	}
+}
+
+func TestRefsFingerprint(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createTestRepo(filepath.Join(dir, "a"), t)
+	got, err := RefsFingerprint(repo)
+	if err != nil {
+		t.Fatalf("RefsFingerprint(repo) failed: %v", err)
+	}
+	// SHA1 of an empty string, since the repository doesn't have any tags.
+	want := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	if got != want {
+		t.Errorf("RefsFingerprint(repo) = %v; want %v", got, want)
 	}
 }
 
@@ -0,0 +1,274 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchDebounce is how long the watcher waits for further file system events
+// before checking a repository. A push usually touches several files.
+const watchDebounce = 100 * time.Millisecond
+
+// Watcher detects changes to the repositories in the storage directory and
+// publishes them as events. It watches the refs/ directory and the
+// packed-refs file of every repository via fsnotify, as well as the storage
+// directory for new repositories. Repositories are additionally rescanned
+// every interval, which is the only way of detecting changes on file systems
+// that don't support fsnotify.
+//
+// A repository is considered changed if the fingerprint of its refs changed,
+// see RefsFingerprint.
+type Watcher struct {
+	storage  *Storage
+	bus      *Bus
+	interval time.Duration
+	onError  func(error)
+	fs       *fsnotify.Watcher
+
+	// fingerprints is only accessed by the watcher's goroutine.
+	fingerprints map[string]string
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWatcher starts watching the storage directory. Events are published to
+// bus. The periodic rescan is disabled if interval is zero. Errors that don't
+// stop the watcher are passed to onError.
+func NewWatcher(s *Storage, bus *Bus, interval time.Duration,
+	onError func(error)) (*Watcher, error) {
+	w := &Watcher{
+		storage:      s,
+		bus:          bus,
+		interval:     interval,
+		onError:      onError,
+		fingerprints: map[string]string{},
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		if interval == 0 {
+			return nil, err
+		}
+		w.reportErr(err)
+	} else {
+		w.fs = fs
+		if err := fs.Add(s.Dir); err != nil {
+			fs.Close()
+			return nil, err
+		}
+	}
+	w.scan(false)
+	go w.run()
+	return w, nil
+}
+
+// Close stops the watcher. It is safe to call Close more than once.
+func (w *Watcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		<-w.done
+		if w.fs != nil {
+			err = w.fs.Close()
+		}
+	})
+	return err
+}
+
+// run processes file system events and rescans the storage directory until
+// the watcher is closed.
+func (w *Watcher) run() {
+	defer close(w.done)
+
+	var rescan <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+	var events <-chan fsnotify.Event
+	var errors <-chan error
+	if w.fs != nil {
+		events, errors = w.fs.Events, w.fs.Errors
+	}
+
+	dirty := map[string]bool{}
+	var debounce <-chan time.Time
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			name := w.repoName(e.Name)
+			if name == "" {
+				continue
+			}
+			if e.Op&fsnotify.Create != 0 {
+				w.watch(name)
+			}
+			dirty[name] = true
+			if debounce == nil {
+				debounce = time.After(watchDebounce)
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			w.reportErr(err)
+		case <-debounce:
+			for name := range dirty {
+				w.check(name, true)
+			}
+			dirty = map[string]bool{}
+			debounce = nil
+		case <-rescan:
+			w.scan(true)
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// scan checks all repositories and detects removed ones.
+func (w *Watcher) scan(publish bool) {
+	names, err := w.storage.Ls()
+	if err != nil {
+		w.reportErr(err)
+		return
+	}
+	found := map[string]bool{}
+	for _, name := range names {
+		found[name] = true
+		w.watch(name)
+		w.check(name, publish)
+	}
+	for name := range w.fingerprints {
+		if !found[name] {
+			w.check(name, publish)
+		}
+	}
+}
+
+// check compares the current fingerprint of a repository with the previous
+// one and publishes an event if it changed.
+func (w *Watcher) check(name string, publish bool) {
+	if strings.HasPrefix(name, "@") && !strings.Contains(name, "/") {
+		// A scope directory, whose repositories are watched separately.
+		return
+	}
+	previous, known := w.fingerprints[name]
+	repo, err := w.storage.GetRepo(name)
+	if Kind(err) == ErrPackageNotFound {
+		if known {
+			delete(w.fingerprints, name)
+			if publish {
+				w.bus.Publish(Event{Name: name, Removed: true})
+			}
+		}
+		return
+	}
+	if err != nil {
+		// The repository might still be being created.
+		return
+	}
+	fingerprint, err := RefsFingerprint(repo)
+	repo.Free()
+	if err != nil {
+		w.reportErr(err)
+		return
+	}
+	if known && fingerprint == previous {
+		return
+	}
+	w.fingerprints[name] = fingerprint
+	if publish {
+		w.bus.Publish(Event{Name: name})
+	}
+}
+
+// watch adds the refs of the named repository, or all repositories of a
+// scope, to the file system watcher. Paths that don't exist (yet) are
+// skipped.
+func (w *Watcher) watch(name string) {
+	if w.fs == nil {
+		return
+	}
+	dir := filepath.Join(w.storage.Dir, name)
+	if strings.HasPrefix(name, "@") && !strings.Contains(name, "/") {
+		w.fs.Add(dir)
+		files, _ := ioutil.ReadDir(dir)
+		for _, file := range files {
+			if file.IsDir() {
+				w.watch(name + "/" + file.Name())
+			}
+		}
+		return
+	}
+	if strings.HasPrefix(name, "@") {
+		w.fs.Add(filepath.Dir(dir))
+	}
+	gitDir := dir
+	if info, err := os.Stat(filepath.Join(dir, ".git")); err == nil && info.IsDir() {
+		gitDir = filepath.Join(dir, ".git")
+	}
+	for _, path := range []string{
+		dir,
+		gitDir,
+		filepath.Join(gitDir, "refs"),
+		filepath.Join(gitDir, "refs", "tags"),
+	} {
+		w.fs.Add(path)
+	}
+}
+
+// repoName returns the name of the repository (or scope directory) that
+// contains path, or an empty string for the storage directory itself.
+func (w *Watcher) repoName(path string) string {
+	rel, err := filepath.Rel(w.storage.Dir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 3)
+	if strings.HasPrefix(parts[0], "@") && len(parts) > 1 {
+		return parts[0] + "/" + parts[1]
+	}
+	return parts[0]
+}
+
+// reportErr passes err to the error callback, if any.
+func (w *Watcher) reportErr(err error) {
+	if w.onError != nil {
+		w.onError(err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	var a, b []Event
+	unsubscribeA := bus.Subscribe(func(e Event) { a = append(a, e) })
+	bus.Subscribe(func(e Event) { b = append(b, e) })
+
+	bus.Publish(Event{Name: "tape"})
+	unsubscribeA()
+	bus.Publish(Event{Name: "ied", Removed: true})
+
+	if want := []Event{{Name: "tape"}}; !reflect.DeepEqual(a, want) {
+		t.Errorf("events of unsubscribed subscriber = %v; want %v", a, want)
+	}
+	if want := []Event{{Name: "tape"}, {Name: "ied", Removed: true}}; !reflect.DeepEqual(b, want) {
+		t.Errorf("events = %v; want %v", b, want)
+	}
+}
+
+func TestWatcherScan(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	createTestRepo(filepath.Join(dir, "a"), t)
+
+	bus := NewBus()
+	events := []Event{}
+	bus.Subscribe(func(e Event) { events = append(events, e) })
+	w := &Watcher{
+		storage:      createStorage(dir, t),
+		bus:          bus,
+		fingerprints: map[string]string{},
+	}
+	w.scan(false)
+	if len(events) != 0 {
+		t.Errorf("initial scan published %v; want none", events)
+	}
+
+	createTestRepo(filepath.Join(dir, "b"), t)
+	createTestRepo(filepath.Join(dir, "@scope", "c"), t)
+	if err := os.RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Fatalf("os.RemoveAll failed: %v", err)
+	}
+	w.scan(true)
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	want := []Event{{Name: "@scope/c"}, {Name: "a", Removed: true}, {Name: "b"}}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("scan published %v; want %v", events, want)
+	}
+
+	events = events[:0]
+	w.scan(true)
+	if len(events) != 0 {
+		t.Errorf("scan without changes published %v; want none", events)
+	}
+}
+
+func TestWatcherRepoName(t *testing.T) {
+	w := &Watcher{storage: &Storage{"/storage"}}
+	tests := []struct {
+		path string
+		name string
+	}{
+		{"/storage", ""},
+		{"/other/tape", ""},
+		{"/storage/tape", "tape"},
+		{"/storage/tape/.git/refs/tags/v1.0.0", "tape"},
+		{"/storage/@scope", "@scope"},
+		{"/storage/@scope/tape/refs/tags", "@scope/tape"},
+	}
+	for _, tt := range tests {
+		if name := w.repoName(tt.path); name != tt.name {
+			t.Errorf("w.repoName(%q) = %q; want %q", tt.path, name, tt.name)
+		}
+	}
+}
+
+func TestWatcherNewRepo(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	bus := NewBus()
+	events := make(chan Event, 10)
+	bus.Subscribe(func(e Event) { events <- e })
+	w, err := NewWatcher(createStorage(dir, t), bus, 0, func(err error) {
+		t.Errorf("watcher failed: %v", err)
+	})
+	if err != nil {
+		t.Fatalf("NewWatcher() failed: %v", err)
+	}
+	defer w.Close()
+
+	createTestRepo(filepath.Join(dir, "a"), t)
+	select {
+	case e := <-events:
+		if want := (Event{Name: "a"}); e != want {
+			t.Errorf("event = %v; want %v", e, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event for new repository")
+	}
+}
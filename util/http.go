@@ -46,6 +46,41 @@ func RespondJSON(w http.ResponseWriter, code int, data interface{}) error {
 	return err
 }
 
+// StatusWriter wraps a http.ResponseWriter and records the status code and the
+// number of bytes written.
+type StatusWriter struct {
+	http.ResponseWriter
+	Code  int
+	Bytes int64
+}
+
+// WriteHeader records and sends the status code.
+func (w *StatusWriter) WriteHeader(code int) {
+	if w.Code == 0 {
+		w.Code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the number of bytes written. Writing without an explicit
+// call to WriteHeader implies a 200.
+func (w *StatusWriter) Write(b []byte) (int, error) {
+	if w.Code == 0 {
+		w.Code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying writer, if supported. Tarballs are streamed
+// to the client, so this shouldn't get lost.
+func (w *StatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // ErrHandle is a custom HTTP handle that can optionally return an error.
 type ErrHandle func(w http.ResponseWriter, r *http.Request,
 	ps httprouter.Params) error
@@ -54,7 +89,7 @@ type ErrHandle func(w http.ResponseWriter, r *http.Request,
 func ErrHandler(handler ErrHandle) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		if err := handler(w, req, ps); err != nil {
-			contextLog := log.WithFields(GetRequestFields(req))
+			contextLog := ContextLog(req, log.StandardLogger())
 
 			LogErr(contextLog, err, "handler failed")
 			code := http.StatusInternalServerError
@@ -73,3 +73,25 @@ func TestRespondJSONBody(t *testing.T) {
 		t.Errorf("w.Body.String() = %v; want %v", gotBody, wantBody)
 	}
 }
+
+func TestStatusWriterImplicitCode(t *testing.T) {
+	w := &StatusWriter{ResponseWriter: httptest.NewRecorder()}
+	w.Write([]byte("hello"))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code = %v; want %v", w.Code, http.StatusOK)
+	}
+	if w.Bytes != 5 {
+		t.Errorf("w.Bytes = %v; want %v", w.Bytes, 5)
+	}
+}
+
+func TestStatusWriterExplicitCode(t *testing.T) {
+	w := &StatusWriter{ResponseWriter: httptest.NewRecorder()}
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("hello"))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("w.Code = %v; want %v", w.Code, http.StatusNotFound)
+	}
+}
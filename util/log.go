@@ -21,10 +21,23 @@
 package util
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	log "github.com/Sirupsen/logrus"
 	"net/http"
 )
 
+// RequestIDHeader is the header used for propagating request ids.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the length of request ids supplied by clients.
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const logKey contextKey = 0
+
 // LogWarn logs the passed in error.
 func LogWarn(ctx *log.Entry, err error, reason string) {
 	ctx.WithFields(log.Fields{"error": err}).Warn(reason)
@@ -49,3 +62,48 @@ func GetRequestFields(req *http.Request) log.Fields {
 		"URL":        req.URL,
 	}
 }
+
+// NewRequestID generates a new random request id.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// IsValidRequestID checks if a client-supplied request id can safely be
+// propagated and logged.
+func IsValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WithContextLog returns a shallow copy of req that carries the supplied log
+// entry.
+func WithContextLog(req *http.Request, contextLog *log.Entry) *http.Request {
+	ctx := context.WithValue(req.Context(), logKey, contextLog)
+	return req.WithContext(ctx)
+}
+
+// ContextLog returns the log entry attached to the supplied request. If there
+// is none, a new entry is created from logger.
+func ContextLog(req *http.Request, logger *log.Logger) *log.Entry {
+	if req == nil {
+		return log.NewEntry(logger)
+	}
+	if contextLog, ok := req.Context().Value(logKey).(*log.Entry); ok {
+		return contextLog
+	}
+	return logger.WithFields(GetRequestFields(req))
+}
@@ -0,0 +1,56 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+var requestIDTests = []struct {
+	id      string
+	isValid bool
+}{
+	{"", false},
+	{"abc-123_DEF.4", true},
+	{"has space", false},
+	{"new\nline", false},
+	{strings.Repeat("a", maxRequestIDLength), true},
+	{strings.Repeat("a", maxRequestIDLength+1), false},
+}
+
+func TestIsValidRequestID(t *testing.T) {
+	for _, tt := range requestIDTests {
+		if isValid := IsValidRequestID(tt.id); isValid != tt.isValid {
+			t.Errorf("IsValidRequestID(%q) = %t, want %t", tt.id, isValid, tt.isValid)
+		}
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	id := NewRequestID()
+	if !IsValidRequestID(id) {
+		t.Errorf("IsValidRequestID(%q) = %t, want %t", id, false, true)
+	}
+	if other := NewRequestID(); other == id {
+		t.Errorf("NewRequestID() = %q twice", id)
+	}
+}
@@ -20,6 +20,11 @@
 
 package util
 
+import (
+	"errors"
+	"strings"
+)
+
 // IsValid checks if the given name is valid according to the CommonJS spec.
 // Besides the addition of fields to the Package Version Object, this addition
 // to the Packages spec imposes the following restrictions on the “name” and
@@ -30,7 +35,7 @@ package util
 // 4. SHOULD contain only URL-safe characters
 // See http://wiki.commonjs.org/wiki/Packages/Registry#Changes_to_Packages_Spec
 func IsValid(name string) bool {
-	if name[0] == '-' || name == "." || name == ".." {
+	if name == "" || name[0] == '-' || name == "." || name == ".." {
 		return false
 	}
 	for _, c := range name {
@@ -40,3 +45,94 @@ func IsValid(name string) bool {
 	}
 	return true
 }
+
+// MaxPkgNameLength is the maximum length of a package name, including the
+// scope.
+const MaxPkgNameLength = 214
+
+// blacklistedPkgNames can't be used as package names.
+var blacklistedPkgNames = map[string]bool{
+	"node_modules": true,
+	"favicon.ico":  true,
+}
+
+// Errors returned by ValidatePkgName and ValidateLegacyPkgName.
+var (
+	ErrPkgNameEmpty       = errors.New("name length must be greater than zero")
+	ErrPkgNameTooLong     = errors.New("name can no longer contain more than 214 characters")
+	ErrPkgNameLeadingChar = errors.New("name cannot start with a period or underscore")
+	ErrPkgNameUppercase   = errors.New("name can no longer contain capital letters")
+	ErrPkgNameChars       = errors.New("name can only contain URL-friendly characters")
+	ErrPkgNameScope       = errors.New("name has an invalid scope")
+	ErrPkgNameBlacklisted = errors.New("name is blacklisted")
+)
+
+// ValidatePkgName checks if name is a valid name for a new npm package, e.g.
+// "tape" or "@scope/tape". It implements the rules of npm's
+// validate-npm-package-name, but rejects the special characters ~'!()* that
+// are only allowed in legacy package names. Since valid names only consist of
+// lowercase letters, digits, "-", "_", "." and the scope separator, they can
+// safely be used as paths.
+// See https://github.com/npm/validate-npm-package-name
+func ValidatePkgName(name string) error {
+	return validatePkgName(name, false)
+}
+
+// ValidateLegacyPkgName checks if name is a valid name for an existing npm
+// package. Unlike ValidatePkgName, it accepts capital letters, the special
+// characters ~'!()* and names longer than MaxPkgNameLength, since packages
+// published before npm tightened its rules might use them, e.g. "JSONStream".
+// The scope is validated as strictly as by ValidatePkgName and valid names can
+// still safely be used as paths.
+func ValidateLegacyPkgName(name string) error {
+	return validatePkgName(name, true)
+}
+
+func validatePkgName(name string, legacy bool) error {
+	if name == "" {
+		return ErrPkgNameEmpty
+	}
+	if !legacy && len(name) > MaxPkgNameLength {
+		return ErrPkgNameTooLong
+	}
+	if blacklistedPkgNames[strings.ToLower(name)] {
+		return ErrPkgNameBlacklisted
+	}
+	if name[0] == '@' {
+		i := strings.IndexByte(name, '/')
+		if i < 0 {
+			return ErrPkgNameScope
+		}
+		scope := name[1:i]
+		if scope == "" || validatePkgNamePart(scope, false) != nil {
+			return ErrPkgNameScope
+		}
+		name = name[i+1:]
+		if name == "" {
+			return ErrPkgNameEmpty
+		}
+	}
+	return validatePkgNamePart(name, legacy)
+}
+
+// validatePkgNamePart validates an unscoped package name or the scope of a
+// package name.
+func validatePkgNamePart(name string, legacy bool) error {
+	if name[0] == '.' || name[0] == '_' {
+		return ErrPkgNameLeadingChar
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		case c >= 'A' && c <= 'Z':
+			if !legacy {
+				return ErrPkgNameUppercase
+			}
+		case legacy && strings.ContainsRune("~'!()*", c):
+		default:
+			return ErrPkgNameChars
+		}
+	}
+	return nil
+}
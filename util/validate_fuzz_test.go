@@ -0,0 +1,85 @@
+// Copyright © 2016 Alexander Gugel <alexander.gugel@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build go1.18
+// +build go1.18
+
+package util
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func FuzzValidatePkgName(f *testing.F) {
+	for _, tt := range nameTests {
+		f.Add(tt.name)
+	}
+	f.Add("@scope/tape")
+	f.Add("@scope/../tape")
+	f.Add("../../etc/passwd")
+	f.Fuzz(func(t *testing.T, name string) {
+		if ValidatePkgName(name) != nil {
+			return
+		}
+		if len(name) > MaxPkgNameLength {
+			t.Errorf("ValidatePkgName(%q) accepted a name longer than %v", name, MaxPkgNameLength)
+		}
+		if name != strings.ToLower(name) {
+			t.Errorf("ValidatePkgName(%q) accepted a name with capital letters", name)
+		}
+		dir := "/storage"
+		rel, err := filepath.Rel(dir, filepath.Join(dir, name))
+		if err != nil || rel != name {
+			t.Errorf("ValidatePkgName(%q) accepted a name that resolves to %q", name, rel)
+		}
+	})
+}
+
+func FuzzValidateLegacyPkgName(f *testing.F) {
+	for _, tt := range nameTests {
+		f.Add(tt.name)
+	}
+	f.Add("JSONStream")
+	f.Add("@scope/../tape")
+	f.Add("../../etc/passwd")
+	f.Fuzz(func(t *testing.T, name string) {
+		if ValidateLegacyPkgName(name) != nil {
+			return
+		}
+		dir := "/storage"
+		rel, err := filepath.Rel(dir, filepath.Join(dir, name))
+		if err != nil || rel != name {
+			t.Errorf("ValidateLegacyPkgName(%q) accepted a name that resolves to %q", name, rel)
+		}
+	})
+}
+
+func FuzzIsValid(f *testing.F) {
+	for _, tt := range nameTests {
+		f.Add(tt.name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		if IsValid(name) && strings.Contains(name, "/") {
+			t.Errorf("IsValid(%q) accepted a name containing %q", name, "/")
+		}
+	})
+}
@@ -20,7 +20,10 @@
 
 package util
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 var nameTests = []struct {
 	name    string
@@ -35,6 +38,7 @@ var nameTests = []struct {
 	{"..", false},
 	{".", false},
 	{"-", false},
+	{"", false},
 }
 
 func TestIsValid(t *testing.T) {
@@ -45,3 +49,75 @@ func TestIsValid(t *testing.T) {
 		}
 	}
 }
+
+func TestValidatePkgName(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"tape", nil},
+		{"some-package_1.0", nil},
+		{"@scope/tape", nil},
+		{"@my-org/tape.js", nil},
+		{"", ErrPkgNameEmpty},
+		{"@scope/", ErrPkgNameEmpty},
+		{strings.Repeat("a", MaxPkgNameLength), nil},
+		{strings.Repeat("a", MaxPkgNameLength+1), ErrPkgNameTooLong},
+		{".tape", ErrPkgNameLeadingChar},
+		{"_tape", ErrPkgNameLeadingChar},
+		{"..", ErrPkgNameLeadingChar},
+		{"@scope/..", ErrPkgNameLeadingChar},
+		{"Tape", ErrPkgNameUppercase},
+		{"@scope/Tape", ErrPkgNameUppercase},
+		{" tape", ErrPkgNameChars},
+		{"ta pe", ErrPkgNameChars},
+		{"tape!", ErrPkgNameChars},
+		{"t/ape", ErrPkgNameChars},
+		{"ta%2fpe", ErrPkgNameChars},
+		{"tapé", ErrPkgNameChars},
+		{"@scope/ta/pe", ErrPkgNameChars},
+		{"@", ErrPkgNameScope},
+		{"@scope", ErrPkgNameScope},
+		{"@/tape", ErrPkgNameScope},
+		{"@../tape", ErrPkgNameScope},
+		{"@Scope/tape", ErrPkgNameScope},
+		{"node_modules", ErrPkgNameBlacklisted},
+		{"favicon.ico", ErrPkgNameBlacklisted},
+	}
+	for _, tt := range tests {
+		if err := ValidatePkgName(tt.name); err != tt.err {
+			t.Errorf("ValidatePkgName(%q) = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestValidateLegacyPkgName(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"tape", nil},
+		{"JSONStream", nil},
+		{"@scope/Tape", nil},
+		{"ta~pe'!()*", nil},
+		{strings.Repeat("a", MaxPkgNameLength+1), nil},
+		{"", ErrPkgNameEmpty},
+		{"@scope/", ErrPkgNameEmpty},
+		{".tape", ErrPkgNameLeadingChar},
+		{"..", ErrPkgNameLeadingChar},
+		{"@scope/..", ErrPkgNameLeadingChar},
+		{"ta pe", ErrPkgNameChars},
+		{"t/ape", ErrPkgNameChars},
+		{"ta%2fpe", ErrPkgNameChars},
+		{"@scope/ta/pe", ErrPkgNameChars},
+		{"@../tape", ErrPkgNameScope},
+		{"@Scope/tape", ErrPkgNameScope},
+		{"@sco(pe)/tape", ErrPkgNameScope},
+		{"Node_Modules", ErrPkgNameBlacklisted},
+	}
+	for _, tt := range tests {
+		if err := ValidateLegacyPkgName(tt.name); err != tt.err {
+			t.Errorf("ValidateLegacyPkgName(%q) = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}